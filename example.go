@@ -35,7 +35,7 @@ func main() {
 	// Register handlers:
 	i.AddEventHandler(types.FileEventHandlerFuncs{
 		// AddFunc is called when the file is added to the store (observed).
-		// AddFunc is also called when the resync happens (every 3 seconds in this example)
+		// The resync (every 3 seconds in this example) calls the handlers only for the changes the watcher missed.
 		AddFunc: func(item interface{}) {
 			f := item.(types.File)
 			log.Printf("OnAdd called for %q (content: %s)", f.Name(), string(f.Content()))
@@ -68,9 +68,8 @@ func main() {
 		}
 	}
 
-	// Now create the second sample file. We registered it when we started the informer, so on every relist, the informer
-	// will attempt to add it into store when it is available.
-	// TODO: In future we can watch the directory which will avoid waiting for resync
+	// Now create the second sample file. We registered it when we started the informer, so the informer watches its
+	// directory and adds it into store when it is created.
 	time.Sleep(5 * time.Second)
 	log.Printf("Creating %s file ...", paths[1])
 	ioutil.WriteFile(paths[1], []byte("future sample"), os.ModePerm)
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bytes"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// DedupStats describes the content shared between the stored files. Only the files holding their content in
+// memory are counted.
+type DedupStats struct {
+	// Files is the number of stored files with interned content.
+	Files int
+	// UniqueContents is the number of distinct contents.
+	UniqueContents int
+	// LogicalBytes is the content size of all files, StoredBytes is the size of the distinct contents.
+	LogicalBytes int64
+	StoredBytes  int64
+}
+
+// Ratio returns the logical to stored bytes ratio. The ratio is 1 when no content is shared.
+func (s DedupStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+type internedContent struct {
+	content []byte
+	refs    int
+}
+
+// contentInterner keeps a single copy of identical content, keyed by the content digest. The files hashed by
+// different algorithms do not share the content. The content with the colliding digest is not interned. Must be guarded by the store lock.
+type contentInterner struct {
+	contents map[types.Digest]*internedContent
+	// keys maps the store key to the interned content digest
+	keys map[string]types.Digest
+}
+
+func newContentInterner() *contentInterner {
+	return &contentInterner{contents: map[types.Digest]*internedContent{}, keys: map[string]types.Digest{}}
+}
+
+// intern replaces the content of the file stored under the key with the shared copy. The digest must be
+// computed before the store lock is taken (see threadSafeStore.prepare).
+func (i *contentInterner) intern(key string, f types.File) {
+	i.release(key)
+	shared, ok := types.Unwrap(f).(types.SharedContent)
+	if !ok {
+		return
+	}
+	content, ok := shared.ResidentContent()
+	if !ok {
+		return
+	}
+	digest := f.Digest()
+	if len(digest) == 0 {
+		return
+	}
+	if existing, ok := i.contents[digest]; ok {
+		// The non-cryptographic digests (eg. xxhash) might collide, the content is shared only when identical
+		if !bytes.Equal(existing.content, content) {
+			return
+		}
+		shared.ShareContent(existing.content)
+		existing.refs++
+	} else {
+		i.contents[digest] = &internedContent{content: content, refs: 1}
+	}
+	i.keys[key] = digest
+}
+
+// release drops the reference of the key, the content is freed when the last reference drops.
+func (i *contentInterner) release(key string) {
+	digest, ok := i.keys[key]
+	if !ok {
+		return
+	}
+	delete(i.keys, key)
+	if c := i.contents[digest]; c != nil {
+		if c.refs--; c.refs <= 0 {
+			delete(i.contents, digest)
+		}
+	}
+}
+
+// contentRefs counts the references to the file versions from the stored items, the version history and the
+// watch history. The content of the version is retained (eg. moved to the ContentCache) with the first
+// reference and released when the last reference drops. Must be guarded by the store lock.
+type contentRefs map[types.ContentRetainer]int
+
+func (r contentRefs) retain(obj interface{}) {
+	retainer, ok := contentRetainer(obj)
+	if !ok {
+		return
+	}
+	r[retainer]++
+	if r[retainer] == 1 {
+		retainer.RetainContent()
+	}
+}
+
+func (r contentRefs) release(obj interface{}) {
+	retainer, ok := contentRetainer(obj)
+	if !ok {
+		return
+	}
+	if r[retainer]--; r[retainer] <= 0 {
+		delete(r, retainer)
+		retainer.ReleaseContent()
+	}
+}
+
+func contentRetainer(obj interface{}) (types.ContentRetainer, bool) {
+	f, ok := obj.(types.File)
+	if !ok {
+		return nil, false
+	}
+	retainer, ok := types.Unwrap(f).(types.ContentRetainer)
+	return retainer, ok
+}
+
+func (i *contentInterner) stats() DedupStats {
+	stats := DedupStats{Files: len(i.keys), UniqueContents: len(i.contents)}
+	for _, c := range i.contents {
+		stats.LogicalBytes += int64(len(c.content) * c.refs)
+		stats.StoredBytes += int64(len(c.content))
+	}
+	return stats
+}
+
+// DedupStats returns the statistics of the content shared between the stored files.
+func (c *threadSafeStore) DedupStats() DedupStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.contents.stats()
+}
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// HistoryOptions controls how many versions of each file the store retains. When both are zero, no history
+// is kept. The current version is always retained.
+type HistoryOptions struct {
+	// MaxVersions is the maximum number of retained versions per file, including the current version.
+	MaxVersions int
+	// MaxAge is the maximum age of the retained versions.
+	MaxAge time.Duration
+	// Clock is used to record the time of the versions. Defaults to the real clock.
+	Clock clock.Clock
+}
+
+func (o HistoryOptions) enabled() bool {
+	return o.MaxVersions > 0 || o.MaxAge > 0
+}
+
+type version struct {
+	// file is nil when the file was deleted at the revision
+	file       types.File
+	revision   uint64
+	recordedAt time.Time
+}
+
+// versionHistory keeps the versions of the stored files. Must be guarded by the store lock.
+type versionHistory struct {
+	options  HistoryOptions
+	versions map[string][]version
+	// refs retains the content of the versions while they are in the history
+	refs contentRefs
+	// lastPrune is the time the expired versions of all keys were dropped
+	lastPrune time.Time
+}
+
+func newVersionHistory(options HistoryOptions, refs contentRefs) *versionHistory {
+	options.Clock = clock.Default(options.Clock)
+	return &versionHistory{options: options, versions: map[string][]version{}, refs: refs, lastPrune: options.Clock.Now()}
+}
+
+func (h *versionHistory) record(key string, f types.File, revision uint64) {
+	if !h.options.enabled() {
+		return
+	}
+	now := h.options.Clock.Now()
+	if f != nil {
+		h.refs.retain(f)
+	}
+	versions := append(h.versions[key], version{file: f, revision: revision, recordedAt: now})
+	first := 0
+	if h.options.MaxVersions > 0 && len(versions) > h.options.MaxVersions {
+		first = len(versions) - h.options.MaxVersions
+	}
+	first += h.expired(versions[first:], now)
+	h.set(key, versions, first)
+	// The keys that are not written anymore keep their expired versions until pruned
+	if h.options.MaxAge > 0 && now.Sub(h.lastPrune) >= h.options.MaxAge/2 {
+		h.prune(now)
+	}
+}
+
+// expired returns the number of the oldest versions recorded before the MaxAge. The last version is always
+// retained.
+func (h *versionHistory) expired(versions []version, now time.Time) int {
+	if h.options.MaxAge <= 0 {
+		return 0
+	}
+	cutoff := now.Add(-h.options.MaxAge)
+	i := 0
+	for i < len(versions)-1 && versions[i].recordedAt.Before(cutoff) {
+		i++
+	}
+	return i
+}
+
+// set keeps the versions of the key starting at first and releases the content of the dropped versions.
+func (h *versionHistory) set(key string, versions []version, first int) {
+	for _, v := range versions[:first] {
+		if v.file != nil {
+			h.refs.release(v.file)
+		}
+	}
+	versions = versions[first:]
+	// Forget the deleted file when only the deletion is retained
+	if len(versions) == 0 || (len(versions) == 1 && versions[0].file == nil) {
+		delete(h.versions, key)
+		return
+	}
+	h.versions[key] = append([]version(nil), versions...)
+}
+
+// prune drops the expired versions of all keys.
+func (h *versionHistory) prune(now time.Time) {
+	h.lastPrune = now
+	for key, versions := range h.versions {
+		if first := h.expired(versions, now); first > 0 {
+			h.set(key, versions, first)
+		}
+	}
+}
+
+// retained returns the versions of the key that did not expire.
+func (h *versionHistory) retained(key string) []version {
+	versions := h.versions[key]
+	return versions[h.expired(versions, h.options.Clock.Now()):]
+}
+
+func (h *versionHistory) list(key string) []interface{} {
+	var files []interface{}
+	for _, v := range h.retained(key) {
+		if v.file != nil {
+			files = append(files, v.file)
+		}
+	}
+	return files
+}
+
+func (h *versionHistory) atRevision(key string, revision uint64) (interface{}, bool, error) {
+	versions := h.retained(key)
+	if len(versions) == 0 || versions[0].revision > revision {
+		return nil, false, errors.Wrapf(ErrRevisionTooOld, "%q at revision %d is not retained", key, revision)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].revision > revision {
+			continue
+		}
+		if versions[i].file == nil {
+			return nil, false, nil
+		}
+		return versions[i].file, true, nil
+	}
+	return nil, false, nil
+}
+
+// History returns the retained versions of the file, oldest first. The last item is the current version
+// unless the file was deleted.
+func (c *threadSafeStore) History(key string) []interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.versions.list(key)
+}
+
+// GetAtRevision returns the version of the file that was stored at the given store revision.
+func (c *threadSafeStore) GetAtRevision(key string, revision uint64) (interface{}, bool, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.versions.atRevision(key, revision)
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// IndexFunc computes the indexed values for the file.
+type IndexFunc func(f types.File) ([]string, error)
+
+// Indexers maps the index name to the function that computes the indexed values.
+type Indexers map[string]IndexFunc
+
+// Indexer is the Store with secondary indexes.
+type Indexer interface {
+	Store
+
+	// ByIndex returns the stored files that have the indexed value in the named index.
+	ByIndex(indexName, indexedValue string) ([]interface{}, error)
+	// IndexKeys returns the keys of the stored files that have the indexed value in the named index.
+	IndexKeys(indexName, indexedValue string) ([]string, error)
+	// ListIndexFuncValues returns all indexed values in the named index.
+	ListIndexFuncValues(indexName string) []string
+
+	GetIndexers() Indexers
+	// AddIndexers adds more indexers. The new indexers are computed for all stored files.
+	AddIndexers(newIndexers Indexers) error
+}
+
+const (
+	ParentDirIndex   = "parentDir"
+	ExtensionIndex   = "extension"
+	ContentHashIndex = "contentHash"
+	InodeIndex       = "inode"
+)
+
+// DefaultIndexers returns the built-in indexers.
+func DefaultIndexers() Indexers {
+	return Indexers{
+		ParentDirIndex:   ParentDirIndexFunc,
+		ExtensionIndex:   ExtensionIndexFunc,
+		ContentHashIndex: ContentHashIndexFunc,
+	}
+}
+
+// ParentDirIndexFunc indexes the files by the directory they are in.
+func ParentDirIndexFunc(f types.File) ([]string, error) {
+	return []string{filepath.Dir(f.Name())}, nil
+}
+
+// ExtensionIndexFunc indexes the files by the file name extension (eg. ".yaml"). Files without extension are
+// not indexed.
+func ExtensionIndexFunc(f types.File) ([]string, error) {
+	ext := filepath.Ext(f.Name())
+	if len(ext) == 0 {
+		return nil, nil
+	}
+	return []string{ext}, nil
+}
+
+// ContentHashIndexFunc indexes the files by the content digest, which allows to find duplicate files.
+func ContentHashIndexFunc(f types.File) ([]string, error) {
+	return []string{f.Digest().String()}, nil
+}
+
+// InodeIndexFunc indexes the files by the device and inode (eg. "2049:1234"), which allows to pair the renamed
+// files. Files on the filesystems that do not report the inode are not indexed.
+func InodeIndexFunc(f types.File) ([]string, error) {
+	m := f.Metadata()
+	if m.Inode == 0 {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("%d:%d", m.Device, m.Inode)}, nil
+}
+
+// LabelIndexFunc returns the index function that indexes the files by the value of the label in the file
+// content. The label is a line in "label: value" or "label=value" form (eg. "app: frontend").
+func LabelIndexFunc(label string) IndexFunc {
+	labelRegexp := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(label) + `\s*[:=]\s*(.*?)\s*$`)
+	return func(f types.File) ([]string, error) {
+		content, err := f.ReadContent()
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			if match := labelRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+				values = append(values, strings.Trim(match[1], `"'`))
+			}
+		}
+		return values, scanner.Err()
+	}
+}
+
+// index maps the indexed value to the set of file keys
+type index map[string]map[string]struct{}
+
+type indices map[string]index
+
+// indexValues are the values of the indexes computed for a file, by the index name.
+type indexValues map[string][]string
+
+// computeIndexValues computes the values of all indexes for the file.
+func computeIndexValues(indexers Indexers, f types.File, key string) (indexValues, error) {
+	values := make(indexValues, len(indexers))
+	for name, indexFunc := range indexers {
+		indexed, err := indexFunc(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute %q index for %q: %v", name, key, err)
+		}
+		values[name] = indexed
+	}
+	return values, nil
+}
+
+// complete computes the values of the indexers that were added after the values were computed.
+func (v indexValues) complete(indexers Indexers, f types.File, key string) error {
+	for name, indexFunc := range indexers {
+		if _, ok := v[name]; ok {
+			continue
+		}
+		indexed, err := indexFunc(f)
+		if err != nil {
+			return fmt.Errorf("unable to compute %q index for %q: %v", name, key, err)
+		}
+		v[name] = indexed
+	}
+	return nil
+}
+
+// update replaces the old values indexed for the key with the new values. The old values are the values
+// computed when the key was indexed, so the index functions are never called for the old file, which content
+// might not be readable anymore.
+func (i indices) update(key string, oldValues, newValues indexValues) {
+	for name, values := range oldValues {
+		idx := i[name]
+		for _, value := range values {
+			delete(idx[value], key)
+			if len(idx[value]) == 0 {
+				delete(idx, value)
+			}
+		}
+	}
+	for name, values := range newValues {
+		idx, ok := i[name]
+		if !ok {
+			idx = index{}
+			i[name] = idx
+		}
+		for _, value := range values {
+			if _, ok := idx[value]; !ok {
+				idx[value] = map[string]struct{}{}
+			}
+			idx[value][key] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+func TestIndexer(t *testing.T) {
+	indexers := DefaultIndexers()
+	indexers["app"] = LabelIndexFunc("app")
+	indexer := NewIndexer(indexers)
+
+	for _, f := range []*testFile{
+		{name: "/etc/foo/a.yaml", content: []byte("app: frontend\nreplicas: 1")},
+		{name: "/etc/foo/b.yaml", content: []byte("app: frontend\nreplicas: 1")},
+		{name: "/etc/bar/c.conf", content: []byte("app=backend")},
+	} {
+		if err := indexer.Add(f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		indexName    string
+		indexedValue string
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "parent directory",
+			indexName:    ParentDirIndex,
+			indexedValue: "/etc/foo",
+			want:         []string{"/etc/foo/a.yaml", "/etc/foo/b.yaml"},
+		},
+		{
+			name:         "extension",
+			indexName:    ExtensionIndex,
+			indexedValue: ".conf",
+			want:         []string{"/etc/bar/c.conf"},
+		},
+		{
+			name:         "duplicate content",
+			indexName:    ContentHashIndex,
+			indexedValue: (&testFile{content: []byte("app: frontend\nreplicas: 1")}).Digest().String(),
+			want:         []string{"/etc/foo/a.yaml", "/etc/foo/b.yaml"},
+		},
+		{
+			name:         "label",
+			indexName:    "app",
+			indexedValue: "backend",
+			want:         []string{"/etc/bar/c.conf"},
+		},
+		{
+			name:         "unknown index",
+			indexName:    "unknown",
+			indexedValue: "foo",
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := indexer.IndexKeys(tt.indexName, tt.indexedValue)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IndexKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("IndexKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Index values must follow the updates and deletes
+	if err := indexer.Update(&testFile{name: "/etc/foo/b.yaml", content: []byte("app: backend")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := indexer.Delete(&testFile{name: "/etc/bar/c.conf"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	items, err := indexer.ByIndex("app", "backend")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 1 || items[0].(types.File).Name() != "/etc/foo/b.yaml" {
+		t.Errorf("expected only /etc/foo/b.yaml with backend label, got %v", items)
+	}
+	if got := indexer.ListIndexFuncValues(ParentDirIndex); !reflect.DeepEqual(got, []string{"/etc/foo"}) {
+		t.Errorf("ListIndexFuncValues() = %v, want [/etc/foo]", got)
+	}
+}
+
+// lazyFile reads the content on demand, the content changes or disappears with the file on disk.
+type lazyFile struct {
+	testFile
+	readErr error
+}
+
+func (f *lazyFile) ReadContent() ([]byte, error) {
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	return f.content, nil
+}
+
+func TestIndexerStoredValues(t *testing.T) {
+	indexer := NewIndexer(Indexers{"app": LabelIndexFunc("app")})
+	foo := &lazyFile{testFile: testFile{name: "/etc/foo.yaml", content: []byte("app: frontend")}}
+	bar := &lazyFile{testFile: testFile{name: "/etc/bar.yaml", content: []byte("app: frontend")}}
+	for _, f := range []types.File{foo, bar} {
+		if err := indexer.Add(f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The stored version changed on disk, the update must remove the value indexed when it was stored
+	foo.content = []byte("app: backend")
+	if err := indexer.Update(&testFile{name: "/etc/foo.yaml", content: []byte("app: database")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The stored version can't be read anymore, the delete must still succeed
+	bar.readErr = os.ErrNotExist
+	if err := indexer.Delete(bar); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, exists, _ := indexer.GetByKey("/etc/bar.yaml"); exists {
+		t.Errorf("expected /etc/bar.yaml deleted")
+	}
+	if got := indexer.ListIndexFuncValues("app"); !reflect.DeepEqual(got, []string{"database"}) {
+		t.Errorf("ListIndexFuncValues() = %v, want [database]", got)
+	}
+}
+
+func TestIndexerFailedUpdate(t *testing.T) {
+	failingIndexFunc := func(f types.File) ([]string, error) {
+		if string(f.Content()) == "fail" {
+			return nil, os.ErrInvalid
+		}
+		return []string{"ok"}, nil
+	}
+	indexer := NewIndexer(Indexers{"content": func(f types.File) ([]string, error) {
+		return []string{string(f.Content())}, nil
+	}, "failing": failingIndexFunc})
+	if err := indexer.Add(&testFile{name: "/etc/foo", content: []byte("foo")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	revision := indexer.Revision()
+	if err := indexer.Update(&testFile{name: "/etc/foo", content: []byte("fail")}); err == nil {
+		t.Fatalf("expected index error")
+	}
+	// The failed update must not change any index
+	if got := indexer.ListIndexFuncValues("content"); !reflect.DeepEqual(got, []string{"foo"}) {
+		t.Errorf("ListIndexFuncValues() = %v, want [foo]", got)
+	}
+	if got := indexer.ListIndexFuncValues("failing"); !reflect.DeepEqual(got, []string{"ok"}) {
+		t.Errorf("ListIndexFuncValues() = %v, want [ok]", got)
+	}
+	if obj, _, _ := indexer.GetByKey("/etc/foo"); string(obj.(types.File).Content()) != "foo" {
+		t.Errorf("expected the stored file unchanged")
+	}
+	if indexer.Revision() != revision {
+		t.Errorf("expected revision %d, got %d", revision, indexer.Revision())
+	}
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// Snapshot is the checkpoint of the store content. It holds the file metadata and digests, not the content.
+type Snapshot struct {
+	Revision uint64 `json:"revision"`
+	// HashAlgorithm is the algorithm of the file digests, empty when the snapshot has no files.
+	HashAlgorithm types.HashAlgorithm `json:"hashAlgorithm,omitempty"`
+	Files         []SnapshotEntry     `json:"files"`
+}
+
+type SnapshotEntry struct {
+	Path     string         `json:"path"`
+	Digest   types.Digest   `json:"digest"`
+	Metadata types.Metadata `json:"metadata"`
+	Revision uint64         `json:"revision"`
+}
+
+// ErrContentNotAvailable is returned when reading content of the file restored from the snapshot.
+var ErrContentNotAvailable = errors.New("content is not available in snapshot")
+
+// NewSnapshot returns the snapshot of the current store content. The files in the store are expected to use
+// the same hash algorithm.
+func NewSnapshot(store Store) *Snapshot {
+	snapshot := &Snapshot{Revision: store.Revision()}
+	for _, item := range store.List() {
+		f := item.(types.File)
+		if len(snapshot.HashAlgorithm) == 0 {
+			snapshot.HashAlgorithm = f.Digest().Algorithm()
+		}
+		snapshot.Files = append(snapshot.Files, SnapshotEntry{
+			Path:     f.Name(),
+			Digest:   f.Digest(),
+			Metadata: f.Metadata(),
+			Revision: f.Revision(),
+		})
+	}
+	sort.Slice(snapshot.Files, func(i, j int) bool { return snapshot.Files[i].Path < snapshot.Files[j].Path })
+	return snapshot
+}
+
+// SaveSnapshot writes the snapshot of the store to the file. The file is replaced atomically.
+func SaveSnapshot(store Store, fileName string) error {
+	out, err := json.Marshal(NewSnapshot(store))
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The content must be on the disk before the rename, otherwise a crash can leave the truncated snapshot
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// LoadSnapshot reads the snapshot from the file. The error satisfies os.IsNotExist when there is no snapshot.
+func LoadSnapshot(fileName string) (*Snapshot, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(content, snapshot); err != nil {
+		return nil, errors.Wrapf(err, "invalid snapshot %q", fileName)
+	}
+	return snapshot, nil
+}
+
+// File returns the file as it was recorded in the snapshot. The file has no content.
+func (e SnapshotEntry) File() types.File {
+	return &snapshotFile{entry: e}
+}
+
+type snapshotFile struct {
+	entry SnapshotEntry
+}
+
+func (f *snapshotFile) Name() string {
+	return f.entry.Path
+}
+
+func (f *snapshotFile) Stat() os.FileInfo {
+	return &snapshotFileInfo{f.entry}
+}
+
+func (f *snapshotFile) Lstat() os.FileInfo {
+	return &snapshotFileInfo{f.entry}
+}
+
+func (f *snapshotFile) Metadata() types.Metadata {
+	return f.entry.Metadata
+}
+
+func (f *snapshotFile) Open() (io.ReadCloser, error) {
+	return nil, ErrContentNotAvailable
+}
+
+func (f *snapshotFile) Content() []byte {
+	return nil
+}
+
+func (f *snapshotFile) ReadContent() ([]byte, error) {
+	return nil, ErrContentNotAvailable
+}
+
+func (f *snapshotFile) Digest() types.Digest {
+	return f.entry.Digest
+}
+
+func (f *snapshotFile) ContentSum256() string {
+	if f.entry.Digest.Algorithm() == types.SHA256 {
+		return f.entry.Digest.Hex()
+	}
+	return ""
+}
+
+func (f *snapshotFile) Revision() uint64 {
+	return f.entry.Revision
+}
+
+type snapshotFileInfo struct {
+	entry SnapshotEntry
+}
+
+func (i *snapshotFileInfo) Name() string {
+	return filepath.Base(i.entry.Path)
+}
+
+func (i *snapshotFileInfo) Size() int64 {
+	return i.entry.Metadata.Size
+}
+
+func (i *snapshotFileInfo) Mode() os.FileMode {
+	return i.entry.Metadata.Mode
+}
+
+func (i *snapshotFileInfo) ModTime() time.Time {
+	return i.entry.Metadata.ModTime
+}
+
+func (i *snapshotFileInfo) IsDir() bool {
+	return false
+}
+
+func (i *snapshotFileInfo) Sys() interface{} {
+	return nil
+}
@@ -2,8 +2,12 @@ package cache
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 
+	"github.com/pkg/errors"
+
 	"github.com/mfojtik/fsinformer/pkg/types"
 )
 
@@ -11,102 +15,533 @@ type Store interface {
 	Add(obj interface{}) error
 	Update(obj interface{}) error
 	Delete(obj interface{}) error
+	// GetAndDelete deletes the file and returns it as it was stored.
+	GetAndDelete(obj interface{}) (deleted interface{}, err error)
 	List() []interface{}
 	ListKeys() []string
 
 	Get(obj interface{}) (item interface{}, exists bool, err error)
 	GetByKey(key string) (item interface{}, exists bool, err error)
 	Replace([]interface{}, string) error
+	// CompareAndSwap atomically replaces the old file with the new one if the stored file did not change. The
+	// new file is returned as it was stored, with the store revision.
+	CompareAndSwap(old, new interface{}) (stored interface{}, swapped bool, err error)
+	// UpdateWithRevision updates the file only when the stored file is at the expected revision.
+	UpdateWithRevision(obj interface{}, expectedRevision uint64) error
+	// Rename atomically moves the stored old file to the key of the new file. The file stored under the new
+	// key is replaced. The new file is returned as it was stored, with the store revision.
+	Rename(old, new interface{}) (stored interface{}, err error)
+
+	// Revision returns the store revision. The revision is bumped by every mutation.
+	Revision() uint64
+	// Watch streams the store mutations after the given revision. WatchFromOldest streams all retained
+	// mutations, the current Revision() only the future mutations.
+	Watch(fromRevision uint64) (WatchInterface, error)
+
+	// History returns the retained versions of the file, oldest first.
+	History(key string) []interface{}
+	// GetAtRevision returns the version of the file at the given store revision.
+	GetAtRevision(key string, revision uint64) (item interface{}, exists bool, err error)
+
+	// DedupStats returns the statistics of the content shared between the stored files.
+	DedupStats() DedupStats
 
 	Resync() error
 }
 
-type syncMapStore struct {
-	mutex sync.Mutex
-	store sync.Map
+// threadSafeStore guards the items and indices with a single lock. Every mutation (including the indices
+// update) happens atomically under the write lock, reads take the read lock. The index values and digests,
+// which might read the file content, are computed before the write lock is taken.
+type threadSafeStore struct {
+	lock  sync.RWMutex
+	items map[string]types.File
+	// revision is monotonic counter bumped by every mutation
+	revision uint64
+
+	indexers Indexers
+	indices  indices
+	// indexed holds the index values computed when the key was stored
+	indexed map[string]indexValues
+
+	history  *watchHistory
+	versions *versionHistory
+	// contents keeps a single copy of the identical content of the stored files
+	contents *contentInterner
+	// refs retains the content of the file versions held by the items and the histories
+	refs contentRefs
+}
+
+// Options configures the store.
+type Options struct {
+	Indexers Indexers
+
+	// WatchHistorySize is the number of mutations retained for resuming the watch. Defaults to
+	// DefaultWatchHistorySize.
+	WatchHistorySize int
+
+	// History controls the retained versions of each file.
+	History HistoryOptions
 }
 
+// ErrRevisionConflict is returned when the stored file is not at the expected revision.
+var ErrRevisionConflict = errors.New("revision conflict")
+
 func NewStore() Store {
-	return &syncMapStore{
-		store: sync.Map{},
+	return NewIndexer(Indexers{})
+}
+
+// NewIndexer returns the store that maintains the indexes computed by given indexers.
+func NewIndexer(indexers Indexers) Indexer {
+	return NewIndexerWithOptions(Options{Indexers: indexers})
+}
+
+func NewIndexerWithOptions(options Options) Indexer {
+	indexers := options.Indexers
+	if indexers == nil {
+		indexers = Indexers{}
+	}
+	refs := contentRefs{}
+	return &threadSafeStore{
+		items:    map[string]types.File{},
+		indexers: indexers,
+		indices:  indices{},
+		indexed:  map[string]indexValues{},
+		history:  newWatchHistory(options.WatchHistorySize, refs),
+		versions: newVersionHistory(options.History, refs),
+		contents: newContentInterner(),
+		refs:     refs,
 	}
 }
 
-func (c *syncMapStore) Add(obj interface{}) error {
+func toFile(obj interface{}) (types.File, error) {
 	f, ok := obj.(types.File)
 	if !ok {
-		return fmt.Errorf("%#+v is not a file", obj)
+		return nil, fmt.Errorf("%#+v is not a file", obj)
 	}
-	c.store.Store(f.Name(), f)
-	return nil
+	return f, nil
 }
 
-func (c *syncMapStore) Update(obj interface{}) error {
-	_, exists, err := c.Get(obj)
+func (c *threadSafeStore) Add(obj interface{}) error {
+	f, values, err := c.prepare(obj)
 	if err != nil {
 		return err
 	}
-	if !exists {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err = c.put(f, values)
+	return err
+}
+
+// prepare computes the index values and the digest of the file. It must be called without the lock held.
+func (c *threadSafeStore) prepare(obj interface{}) (types.File, indexValues, error) {
+	f, err := toFile(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The digest is cached by the file, so the content is not hashed under the lock by the interning
+	f.Digest()
+	values, err := computeIndexValues(c.GetIndexers(), f, f.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, values, nil
+}
+
+// put stores the file at the next revision and updates the indices with the prepared values. It returns the
+// stored file. Nothing is changed when any of the index values can't be computed. Must be called with the
+// write lock held.
+func (c *threadSafeStore) put(f types.File, values indexValues) (types.File, error) {
+	if err := values.complete(c.indexers, f, f.Name()); err != nil {
+		return nil, err
+	}
+	f = types.WithRevision(f, c.revision+1)
+	old, exists := c.items[f.Name()]
+	c.indices.update(f.Name(), c.indexed[f.Name()], values)
+	c.indexed[f.Name()] = values
+	c.items[f.Name()] = f
+	c.refs.retain(f)
+	c.contents.intern(f.Name(), f)
+	c.revision++
+	c.versions.record(f.Name(), f, c.revision)
+	if exists {
+		c.history.record(Event{Type: Updated, Revision: c.revision, Object: f, OldObject: old})
+		// The replaced version might still be retained by the histories
+		c.refs.release(old)
+	} else {
+		c.history.record(Event{Type: Added, Revision: c.revision, Object: f})
+	}
+	return f, nil
+}
+
+func (c *threadSafeStore) Update(obj interface{}) error {
+	f, values, err := c.prepare(obj)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.items[f.Name()]; !exists {
 		return fmt.Errorf("%#+v does not exists", obj)
 	}
-	return c.Add(obj)
+	_, err = c.put(f, values)
+	return err
+}
+
+// CompareAndSwap replaces the stored old file with the new file atomically. The new file is stored only when
+// the currently stored file has the same revision as the old file (or the same digest when the old file was
+// not read from the store), or when the old is nil and the file is not stored yet. The swapped is false when
+// the stored file changed in the meantime. The stored file is returned, so the callers do not have to get it
+// from the store, where it might be replaced concurrently.
+func (c *threadSafeStore) CompareAndSwap(old, new interface{}) (interface{}, bool, error) {
+	f, values, err := c.prepare(new)
+	if err != nil {
+		return nil, false, err
+	}
+	if old == nil {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if _, exists := c.items[f.Name()]; exists {
+			return nil, false, nil
+		}
+		return c.swap(f, values)
+	}
+	oldFile, err := toFile(old)
+	if err != nil {
+		return nil, false, err
+	}
+	// The old file was not read from the store, compare the digests. The digests are computed without the lock
+	// and the swap fails when the stored file changed in the meantime.
+	var current types.File
+	if oldFile.Revision() == 0 {
+		obj, exists, _ := c.GetByKey(f.Name())
+		if !exists || obj.(types.File).Digest() != oldFile.Digest() {
+			return nil, false, nil
+		}
+		current = obj.(types.File)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stored, exists := c.items[f.Name()]
+	if !exists {
+		return nil, false, nil
+	}
+	if oldFile.Revision() != 0 && stored.Revision() != oldFile.Revision() {
+		return nil, false, nil
+	}
+	if oldFile.Revision() == 0 && stored != current {
+		return nil, false, nil
+	}
+	return c.swap(f, values)
 }
 
-func (c *syncMapStore) Delete(obj interface{}) error {
-	_, exists, err := c.Get(obj)
+// swap stores the file for the CompareAndSwap. Must be called with the write lock held.
+func (c *threadSafeStore) swap(f types.File, values indexValues) (interface{}, bool, error) {
+	stored, err := c.put(f, values)
+	if err != nil {
+		return nil, false, err
+	}
+	return stored, true, nil
+}
+
+func (c *threadSafeStore) UpdateWithRevision(obj interface{}, expectedRevision uint64) error {
+	f, values, err := c.prepare(obj)
 	if err != nil {
 		return err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	current, exists := c.items[f.Name()]
 	if !exists {
 		return fmt.Errorf("%#+v does not exists", obj)
 	}
-	c.store.Delete(obj.(types.File).Name())
-	return nil
+	if current.Revision() != expectedRevision {
+		return errors.Wrapf(ErrRevisionConflict, "%q is at revision %d, expected %d", f.Name(), current.Revision(), expectedRevision)
+	}
+	_, err = c.put(f, values)
+	return err
+}
+
+func (c *threadSafeStore) Revision() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.revision
+}
+
+func (c *threadSafeStore) Delete(obj interface{}) error {
+	_, err := c.GetAndDelete(obj)
+	return err
+}
+
+// GetAndDelete deletes the file stored under the key of the given file and returns the deleted file. The
+// deleted file might be newer than the given file when it was replaced concurrently.
+func (c *threadSafeStore) GetAndDelete(obj interface{}) (interface{}, error) {
+	f, err := toFile(obj)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old, exists := c.items[f.Name()]
+	if !exists {
+		return nil, fmt.Errorf("%#+v does not exists", obj)
+	}
+	c.indices.update(f.Name(), c.indexed[f.Name()], nil)
+	delete(c.indexed, f.Name())
+	delete(c.items, f.Name())
+	c.contents.release(f.Name())
+	c.revision++
+	c.versions.record(f.Name(), nil, c.revision)
+	c.history.record(Event{Type: Deleted, Revision: c.revision, Object: old})
+	c.refs.release(old)
+	return old, nil
 }
 
-func (c *syncMapStore) List() []interface{} {
+func (c *threadSafeStore) Rename(old, new interface{}) (interface{}, error) {
+	oldFile, err := toFile(old)
+	if err != nil {
+		return nil, err
+	}
+	f, values, err := c.prepare(new)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stored, exists := c.items[oldFile.Name()]
+	if !exists {
+		return nil, fmt.Errorf("%#+v does not exists", old)
+	}
+	if oldFile.Name() == f.Name() {
+		return nil, fmt.Errorf("cannot rename %q to itself", f.Name())
+	}
+	if err := values.complete(c.indexers, f, f.Name()); err != nil {
+		return nil, err
+	}
+	f = types.WithRevision(f, c.revision+1)
+	c.indices.update(oldFile.Name(), c.indexed[oldFile.Name()], nil)
+	delete(c.indexed, oldFile.Name())
+	c.indices.update(f.Name(), c.indexed[f.Name()], values)
+	c.indexed[f.Name()] = values
+	replaced, isReplaced := c.items[f.Name()]
+	delete(c.items, oldFile.Name())
+	c.contents.release(oldFile.Name())
+	c.items[f.Name()] = f
+	c.refs.retain(f)
+	c.contents.intern(f.Name(), f)
+	c.revision++
+	c.versions.record(oldFile.Name(), nil, c.revision)
+	c.versions.record(f.Name(), f, c.revision)
+	c.history.record(Event{Type: Renamed, Revision: c.revision, Object: f, OldObject: stored})
+	c.refs.release(stored)
+	if isReplaced {
+		c.refs.release(replaced)
+	}
+	return f, nil
+}
+
+func (c *threadSafeStore) List() []interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	var items []interface{}
-	c.store.Range(func(_, value interface{}) bool {
-		items = append(items, value)
-		return true
-	})
+	for _, item := range c.items {
+		items = append(items, item)
+	}
 	return items
 }
 
-func (c *syncMapStore) ListKeys() []string {
+func (c *threadSafeStore) ListKeys() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	var keys []string
-	c.store.Range(func(key, _ interface{}) bool {
-		keys = append(keys, key.(string))
-		return true
-	})
+	for key := range c.items {
+		keys = append(keys, key)
+	}
 	return keys
 }
 
-func (c *syncMapStore) Get(obj interface{}) (interface{}, bool, error) {
-	f, ok := obj.(types.File)
-	if !ok {
-		return nil, false, fmt.Errorf("%#+v is not a file", obj)
+func (c *threadSafeStore) Get(obj interface{}) (interface{}, bool, error) {
+	f, err := toFile(obj)
+	if err != nil {
+		return nil, false, err
 	}
 	return c.GetByKey(f.Name())
 }
 
-func (c *syncMapStore) GetByKey(key string) (interface{}, bool, error) {
-	item, exists := c.store.Load(key)
-	return item, exists, nil
+func (c *threadSafeStore) GetByKey(key string) (interface{}, bool, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	item, exists := c.items[key]
+	if !exists {
+		return nil, false, nil
+	}
+	return item, true, nil
 }
 
-func (c *syncMapStore) Replace(items []interface{}, _ string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.store = sync.Map{}
+// Replace atomically replaces the store content with the given items. When any of the items is not a file,
+// the store is left unchanged.
+// The resource version, when set, becomes the new store revision and must be newer than the current revision.
+// Otherwise the revision is bumped.
+func (c *threadSafeStore) Replace(items []interface{}, resourceVersion string) error {
+	var revision uint64
+	if len(resourceVersion) > 0 {
+		var err error
+		if revision, err = strconv.ParseUint(resourceVersion, 10, 64); err != nil {
+			return fmt.Errorf("invalid resource version %q: %v", resourceVersion, err)
+		}
+	}
+	files := make([]types.File, 0, len(items))
+	filesValues := make([]indexValues, 0, len(items))
 	for _, item := range items {
-		if err := c.Add(item); err != nil {
+		f, values, err := c.prepare(item)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		filesValues = append(filesValues, values)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if revision == 0 {
+		revision = c.revision + 1
+	}
+	if revision <= c.revision {
+		return fmt.Errorf("resource version %d is not newer than the store revision %d", revision, c.revision)
+	}
+	newItems := make(map[string]types.File, len(files))
+	newIndices, newIndexed := indices{}, map[string]indexValues{}
+	objects := make([]interface{}, 0, len(files))
+	for i, f := range files {
+		values := filesValues[i]
+		if err := values.complete(c.indexers, f, f.Name()); err != nil {
 			return err
 		}
+		f = types.WithRevision(f, revision)
+		newIndices.update(f.Name(), nil, values)
+		newIndexed[f.Name()] = values
+		newItems[f.Name()] = f
+		objects = append(objects, f)
+	}
+	for key := range c.items {
+		if _, exists := newItems[key]; !exists {
+			c.versions.record(key, nil, revision)
+			c.contents.release(key)
+		}
+	}
+	for key, f := range newItems {
+		c.refs.retain(f)
+		c.versions.record(key, f, revision)
+		c.contents.intern(key, f)
 	}
+	oldItems := c.items
+	c.items, c.indices, c.indexed, c.revision = newItems, newIndices, newIndexed, revision
+	c.history.record(Event{Type: Replaced, Revision: c.revision, Objects: objects})
+	for _, old := range oldItems {
+		c.refs.release(old)
+	}
+	return nil
+}
+
+func (c *threadSafeStore) Resync() error {
 	return nil
 }
 
-func (c *syncMapStore) Resync() error {
+func (c *threadSafeStore) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	keys, err := c.IndexKeys(indexName, indexedValue)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	items := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if item, exists := c.items[key]; exists {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (c *threadSafeStore) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if _, ok := c.indexers[indexName]; !ok {
+		return nil, fmt.Errorf("index with name %s does not exist", indexName)
+	}
+	keys := make([]string, 0, len(c.indices[indexName][indexedValue]))
+	for key := range c.indices[indexName][indexedValue] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (c *threadSafeStore) ListIndexFuncValues(indexName string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	values := make([]string, 0, len(c.indices[indexName]))
+	for value := range c.indices[indexName] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func (c *threadSafeStore) GetIndexers() Indexers {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	indexers := Indexers{}
+	for name, indexFunc := range c.indexers {
+		indexers[name] = indexFunc
+	}
+	return indexers
+}
+
+func (c *threadSafeStore) AddIndexers(newIndexers Indexers) error {
+	// Compute the new indexes for the stored files without the lock, the files stored in the meantime are
+	// indexed under the lock.
+	c.lock.RLock()
+	items := make(map[string]types.File, len(c.items))
+	for key, f := range c.items {
+		items[key] = f
+	}
+	c.lock.RUnlock()
+	newValues := make(map[string]indexValues, len(items))
+	for key, f := range items {
+		values, err := computeIndexValues(newIndexers, f, key)
+		if err != nil {
+			return err
+		}
+		newValues[key] = values
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name := range newIndexers {
+		if _, exists := c.indexers[name]; exists {
+			return fmt.Errorf("indexer conflict: %s", name)
+		}
+	}
+	for key, f := range c.items {
+		if items[key] == f {
+			continue
+		}
+		values, err := computeIndexValues(newIndexers, f, key)
+		if err != nil {
+			return err
+		}
+		newValues[key] = values
+	}
+	for key, values := range newValues {
+		if _, exists := c.items[key]; !exists {
+			continue
+		}
+		c.indices.update(key, nil, values)
+		for name, indexed := range values {
+			c.indexed[key][name] = indexed
+		}
+	}
+	for name, indexFunc := range newIndexers {
+		c.indexers[name] = indexFunc
+	}
 	return nil
 }
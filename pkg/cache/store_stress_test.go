@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+func Test_threadSafeStore_CompareAndSwap(t *testing.T) {
+	foo := &testFile{name: "/tmp/foo", content: []byte("foo")}
+	updatedFoo := &testFile{name: "/tmp/foo", content: []byte("updated foo")}
+	tests := []struct {
+		name        string
+		items       map[string]types.File
+		old, new    interface{}
+		wantSwapped bool
+		wantErr     bool
+	}{
+		{
+			name:        "swap",
+			items:       map[string]types.File{"/tmp/foo": foo},
+			old:         foo,
+			new:         updatedFoo,
+			wantSwapped: true,
+		},
+		{
+			name:  "stored file changed",
+			items: map[string]types.File{"/tmp/foo": updatedFoo},
+			old:   foo,
+			new:   updatedFoo,
+		},
+		{
+			name:        "add missing",
+			items:       map[string]types.File{},
+			new:         foo,
+			wantSwapped: true,
+		},
+		{
+			name:  "add existing",
+			items: map[string]types.File{"/tmp/foo": foo},
+			new:   updatedFoo,
+		},
+		{
+			name:    "invalid",
+			items:   map[string]types.File{},
+			new:     "foo",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestStore(tt.items)
+			stored, swapped, err := c.CompareAndSwap(tt.old, tt.new)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("threadSafeStore.CompareAndSwap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if swapped != tt.wantSwapped {
+				t.Errorf("threadSafeStore.CompareAndSwap() swapped = %v, want %v", swapped, tt.wantSwapped)
+			}
+			if swapped && stored.(types.File).Revision() != c.Revision() {
+				t.Errorf("threadSafeStore.CompareAndSwap() stored revision = %d, want %d", stored.(types.File).Revision(), c.Revision())
+			}
+		})
+	}
+}
+
+// Test_threadSafeStore_Stress runs concurrent mutations and reads, it is meant to be run with -race.
+func Test_threadSafeStore_Stress(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 500
+		files      = 16
+	)
+	indexer := NewIndexer(DefaultIndexers())
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < iterations; i++ {
+				f := &testFile{
+					name:    fmt.Sprintf("/tmp/%d.txt", r.Intn(files)),
+					content: []byte(fmt.Sprintf("%d", r.Intn(4))),
+				}
+				switch r.Intn(7) {
+				case 0:
+					_ = indexer.Add(f)
+				case 1:
+					_ = indexer.Update(f)
+				case 2:
+					_ = indexer.Delete(f)
+				case 3:
+					if old, exists, _ := indexer.Get(f); exists {
+						_, _, _ = indexer.CompareAndSwap(old, f)
+					}
+				case 4:
+					if r.Intn(20) == 0 {
+						_ = indexer.Replace([]interface{}{f}, "")
+					}
+				case 5:
+					indexer.List()
+					indexer.ListKeys()
+				case 6:
+					_, _ = indexer.ByIndex(ContentHashIndex, f.Digest().String())
+					indexer.ListIndexFuncValues(ParentDirIndex)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	// The indices must be consistent with the stored items
+	for _, item := range indexer.List() {
+		f := item.(types.File)
+		keys, err := indexer.IndexKeys(ContentHashIndex, f.Digest().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		found := false
+		for _, key := range keys {
+			found = found || key == f.Name()
+		}
+		if !found {
+			t.Errorf("%q is missing in the content hash index", f.Name())
+		}
+	}
+	indexedCount := 0
+	for _, value := range indexer.ListIndexFuncValues(ExtensionIndex) {
+		keys, _ := indexer.IndexKeys(ExtensionIndex, value)
+		indexedCount += len(keys)
+	}
+	if indexedCount != len(indexer.ListKeys()) {
+		t.Errorf("expected %d indexed files, got %d", len(indexer.ListKeys()), indexedCount)
+	}
+}
@@ -1,16 +1,24 @@
 package cache
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
-	"sync"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
 	"github.com/mfojtik/fsinformer/pkg/types"
 )
 
 type testFile struct {
-	name string
+	name    string
+	content []byte
 }
 
 func (f *testFile) Name() string {
@@ -21,10 +29,35 @@ func (f *testFile) Stat() os.FileInfo {
 	panic("implement me")
 }
 
-func (f *testFile) Content() []byte {
+func (f *testFile) Lstat() os.FileInfo {
+	panic("implement me")
+}
+
+func (f *testFile) Metadata() types.Metadata {
 	panic("implement me")
 }
 
+func (f *testFile) Open() (io.ReadCloser, error) {
+	panic("implement me")
+}
+
+func (f *testFile) Content() []byte {
+	return f.content
+}
+
+func (f *testFile) ReadContent() ([]byte, error) {
+	return f.content, nil
+}
+
+func (f *testFile) Digest() types.Digest {
+	d, _ := types.ComputeDigest(types.SHA256, bytes.NewReader(f.content))
+	return d
+}
+
+func (f *testFile) Revision() uint64 {
+	return 0
+}
+
 func (f *testFile) ContentSum256() string {
 	panic("implement me")
 }
@@ -33,10 +66,17 @@ func mockFile() types.File {
 	return &testFile{name: "/tmp/foo"}
 }
 
-func Test_syncMapStore_Add(t *testing.T) {
+func newTestStore(items map[string]types.File) *threadSafeStore {
+	c := NewIndexer(nil).(*threadSafeStore)
+	for key, f := range items {
+		c.items[key] = f
+	}
+	return c
+}
+
+func Test_threadSafeStore_Add(t *testing.T) {
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		obj interface{}
@@ -49,37 +89,34 @@ func Test_syncMapStore_Add(t *testing.T) {
 	}{
 		{
 			name:    "default",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: mockFile()},
 			wantErr: false,
 		},
 		{
 			name:    "not file",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: "foo"},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if err := c.Add(tt.args.obj); (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.Add() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.Add() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_Update(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
+func Test_threadSafeStore_Update(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		obj interface{}
@@ -92,43 +129,40 @@ func Test_syncMapStore_Update(t *testing.T) {
 	}{
 		{
 			name:    "default",
-			fields:  fields{store: existingMap},
+			fields:  fields{items: existingMap},
 			args:    args{obj: mockFile()},
 			wantErr: false,
 		},
 		{
 			name:    "not exists",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: mockFile()},
 			wantErr: true,
 		},
 		{
 			name:    "invalid",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: "foo"},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if err := c.Update(tt.args.obj); (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.Update() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.Update() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_Delete(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
+func Test_threadSafeStore_Delete(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		obj interface{}
@@ -141,44 +175,64 @@ func Test_syncMapStore_Delete(t *testing.T) {
 	}{
 		{
 			name:    "default",
-			fields:  fields{store: existingMap},
+			fields:  fields{items: existingMap},
 			args:    args{obj: mockFile()},
 			wantErr: false,
 		},
 		{
 			name:    "not exists",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: mockFile()},
 			wantErr: true,
 		},
 		{
 			name:    "invalid",
-			fields:  fields{store: sync.Map{}},
+			fields:  fields{items: map[string]types.File{}},
 			args:    args{obj: "foo"},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if err := c.Delete(tt.args.obj); (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.Delete() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.Delete() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_List(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
-	existingMap.Store("/tmp/bar", mockFile())
+func Test_threadSafeStore_GetAndDelete(t *testing.T) {
+	c := NewIndexer(nil)
+	foo := &testFile{name: "/tmp/foo", content: []byte("foo")}
+	if err := c.Add(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The file was replaced after the caller got it
+	stored, _, _ := c.Get(foo)
+	if err := c.Update(&testFile{name: "/tmp/foo", content: []byte("updated")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deleted, err := c.GetAndDelete(stored)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f := deleted.(types.File); string(f.Content()) != "updated" || f.Revision() != 2 {
+		t.Errorf("expected the updated file at revision 2 deleted, got %q at %d", string(f.Content()), f.Revision())
+	}
+	if _, err := c.GetAndDelete(stored); err == nil {
+		t.Errorf("expected error deleting the file that is not stored")
+	}
+}
+
+func Test_threadSafeStore_List(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+		"/tmp/bar": mockFile(),
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	tests := []struct {
 		name   string
@@ -187,34 +241,31 @@ func Test_syncMapStore_List(t *testing.T) {
 	}{
 		{
 			name:   "default",
-			fields: fields{store: existingMap},
+			fields: fields{items: existingMap},
 			want:   []interface{}{mockFile(), mockFile()},
 		},
 		{
 			name:   "empty",
-			fields: fields{store: sync.Map{}},
+			fields: fields{items: map[string]types.File{}},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if got := c.List(); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("syncMapStore.List() = %v, want %v", got, tt.want)
+				t.Errorf("threadSafeStore.List() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_ListKeys(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
+func Test_threadSafeStore_ListKeys(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	tests := []struct {
 		name   string
@@ -223,37 +274,33 @@ func Test_syncMapStore_ListKeys(t *testing.T) {
 	}{
 		{
 			name:   "default",
-			fields: fields{store: existingMap},
+			fields: fields{items: existingMap},
 			want:   []string{"/tmp/foo"},
 		},
 		{
 			name:   "empty",
-			fields: fields{store: sync.Map{}},
+			fields: fields{items: map[string]types.File{}},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if got := c.ListKeys(); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("syncMapStore.ListKeys() = %v, want %v", got, tt.want)
+				t.Errorf("threadSafeStore.ListKeys() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_Get(t *testing.T) {
-	existingMap := sync.Map{}
+func Test_threadSafeStore_Get(t *testing.T) {
 	item := mockFile()
 	item2 := &testFile{name: "/tmp/bar"}
-
-	existingMap.Store("/tmp/foo", item)
+	existingMap := map[string]types.File{
+		"/tmp/foo": item,
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		obj interface{}
@@ -269,7 +316,7 @@ func Test_syncMapStore_Get(t *testing.T) {
 		{
 			name: "default",
 			fields: fields{
-				store: existingMap,
+				items: existingMap,
 			},
 			args: args{
 				obj: item,
@@ -281,7 +328,7 @@ func Test_syncMapStore_Get(t *testing.T) {
 		{
 			name: "not exists",
 			fields: fields{
-				store: existingMap,
+				items: existingMap,
 			},
 			args: args{
 				obj: item2,
@@ -293,7 +340,7 @@ func Test_syncMapStore_Get(t *testing.T) {
 		{
 			name: "invalid",
 			fields: fields{
-				store: existingMap,
+				items: existingMap,
 			},
 			args: args{
 				obj: "blah",
@@ -305,32 +352,29 @@ func Test_syncMapStore_Get(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			got, got1, err := c.Get(tt.args.obj)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.Get() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.Get() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("syncMapStore.Get() got = %v, want %v", got, tt.want)
+				t.Errorf("threadSafeStore.Get() got = %v, want %v", got, tt.want)
 			}
 			if got1 != tt.want1 {
-				t.Errorf("syncMapStore.Get() got1 = %v, want %v", got1, tt.want1)
+				t.Errorf("threadSafeStore.Get() got1 = %v, want %v", got1, tt.want1)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_GetByKey(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
+func Test_threadSafeStore_GetByKey(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+	}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		key string
@@ -346,7 +390,7 @@ func Test_syncMapStore_GetByKey(t *testing.T) {
 		{
 			name: "default",
 			fields: fields{
-				store: existingMap,
+				items: existingMap,
 			},
 			args: args{
 				key: "/tmp/foo",
@@ -358,7 +402,7 @@ func Test_syncMapStore_GetByKey(t *testing.T) {
 		{
 			name: "not exists",
 			fields: fields{
-				store: existingMap,
+				items: existingMap,
 			},
 			args: args{
 				key: "/tmp/bar",
@@ -370,33 +414,30 @@ func Test_syncMapStore_GetByKey(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			got, got1, err := c.GetByKey(tt.args.key)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.GetByKey() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.GetByKey() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("syncMapStore.GetByKey() got = %v, want %v", got, tt.want)
+				t.Errorf("threadSafeStore.GetByKey() got = %v, want %v", got, tt.want)
 			}
 			if got1 != tt.want1 {
-				t.Errorf("syncMapStore.GetByKey() got1 = %v, want %v", got1, tt.want1)
+				t.Errorf("threadSafeStore.GetByKey() got1 = %v, want %v", got1, tt.want1)
 			}
 		})
 	}
 }
 
-func Test_syncMapStore_Replace(t *testing.T) {
-	existingMap := sync.Map{}
-	existingMap.Store("/tmp/foo", mockFile())
+func Test_threadSafeStore_Replace(t *testing.T) {
+	existingMap := map[string]types.File{
+		"/tmp/foo": mockFile(),
+	}
 	item2 := &testFile{name: "bar"}
 
 	type fields struct {
-		mutex sync.Mutex
-		store sync.Map
+		items map[string]types.File
 	}
 	type args struct {
 		items []interface{}
@@ -411,7 +452,7 @@ func Test_syncMapStore_Replace(t *testing.T) {
 		{
 			name: "default",
 			fields: fields{
-				store: sync.Map{},
+				items: existingMap,
 			},
 			args: args{
 				items: []interface{}{item2},
@@ -421,7 +462,7 @@ func Test_syncMapStore_Replace(t *testing.T) {
 		{
 			name: "invalid",
 			fields: fields{
-				store: sync.Map{},
+				items: map[string]types.File{},
 			},
 			args: args{
 				items: []interface{}{"foo"},
@@ -431,13 +472,320 @@ func Test_syncMapStore_Replace(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := &syncMapStore{
-				mutex: tt.fields.mutex,
-				store: tt.fields.store,
-			}
+			c := newTestStore(tt.fields.items)
 			if err := c.Replace(tt.args.items, tt.args.in1); (err != nil) != tt.wantErr {
-				t.Errorf("syncMapStore.Replace() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("threadSafeStore.Replace() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func Test_threadSafeStore_Revision(t *testing.T) {
+	c := NewStore()
+	foo := &testFile{name: "/tmp/foo", content: []byte("foo")}
+	if err := c.Add(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Add(&testFile{name: "/tmp/bar"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, _, _ := c.GetByKey("/tmp/foo")
+	if rev := stored.(types.File).Revision(); rev != 1 {
+		t.Errorf("expected /tmp/foo at revision 1, got %d", rev)
+	}
+	if rev := c.Revision(); rev != 2 {
+		t.Errorf("expected store revision 2, got %d", rev)
+	}
+
+	// Stale update must be rejected
+	updatedFoo := &testFile{name: "/tmp/foo", content: []byte("updated foo")}
+	if err := c.UpdateWithRevision(updatedFoo, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.UpdateWithRevision(updatedFoo, 1); errors.Cause(err) != ErrRevisionConflict {
+		t.Errorf("expected revision conflict, got %v", err)
+	}
+	if _, swapped, _ := c.CompareAndSwap(stored, foo); swapped {
+		t.Errorf("expected swap of the stale file to fail")
+	}
+
+	if err := c.Delete(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rev := c.Revision(); rev != 4 {
+		t.Errorf("expected store revision 4, got %d", rev)
+	}
+	if err := c.Replace([]interface{}{foo}, "3"); err == nil {
+		t.Errorf("expected error replacing with older resource version")
+	}
+	if err := c.Replace([]interface{}{foo}, "10"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, _, _ = c.GetByKey("/tmp/foo")
+	if rev := stored.(types.File).Revision(); rev != 10 {
+		t.Errorf("expected /tmp/foo at revision 10, got %d", rev)
+	}
+}
+
+func Test_threadSafeStore_History(t *testing.T) {
+	c := NewIndexerWithOptions(Options{History: HistoryOptions{MaxVersions: 2}})
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err := c.Add(&testFile{name: "/tmp/foo", content: []byte(content)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	history := c.History("/tmp/foo")
+	if len(history) != 2 || string(history[0].(types.File).Content()) != "v2" || string(history[1].(types.File).Content()) != "v3" {
+		t.Errorf("expected [v2 v3] history, got %v", history)
+	}
+	if _, _, err := c.GetAtRevision("/tmp/foo", 1); errors.Cause(err) != ErrRevisionTooOld {
+		t.Errorf("expected ErrRevisionTooOld for pruned revision, got %v", err)
+	}
+	if err := c.Delete(&testFile{name: "/tmp/foo"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, exists, err := c.GetAtRevision("/tmp/foo", 3)
+	if err != nil || !exists || string(got.(types.File).Content()) != "v3" {
+		t.Errorf("expected v3 at revision 3, got %v (exists: %v, err: %v)", got, exists, err)
+	}
+	if _, exists, _ := c.GetAtRevision("/tmp/foo", 4); exists {
+		t.Errorf("expected file to be deleted at revision 4")
+	}
+}
+
+func Test_threadSafeStore_HistoryMaxAge(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	c := NewIndexerWithOptions(Options{History: HistoryOptions{MaxAge: time.Minute, Clock: fakeClock}})
+	for _, content := range []string{"v1", "v2", "v3"} {
+		fakeClock.Advance(45 * time.Second)
+		if err := c.Add(&testFile{name: "/tmp/foo", content: []byte(content)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	history := c.History("/tmp/foo")
+	if len(history) != 2 || string(history[0].(types.File).Content()) != "v2" {
+		t.Errorf("expected [v2 v3] history, got %v", history)
+	}
+
+	// The versions expire even when the file is not written anymore
+	fakeClock.Advance(time.Minute)
+	if history := c.History("/tmp/foo"); len(history) != 1 || string(history[0].(types.File).Content()) != "v3" {
+		t.Errorf("expected [v3] history, got %v", history)
+	}
+	if _, _, err := c.GetAtRevision("/tmp/foo", 2); errors.Cause(err) != ErrRevisionTooOld {
+		t.Errorf("expected ErrRevisionTooOld for expired revision, got %v", err)
+	}
+	if err := c.Add(&testFile{name: "/tmp/bar", content: []byte("bar")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if versions := c.(*threadSafeStore).versions.versions["/tmp/foo"]; len(versions) != 1 {
+		t.Errorf("expected the expired versions pruned, got %d versions", len(versions))
+	}
+}
+
+func Test_threadSafeStore_DedupStats(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	newFile := func(name, content string) types.File {
+		path := filepath.Join(baseDir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		f, err := types.NewFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return f
+	}
+
+	c := newTestStore(nil)
+	foo, bar := newFile("foo", "shared"), newFile("bar", "shared")
+	for _, f := range []types.File{foo, bar, newFile("baz", "other")} {
+		if err := c.Add(f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := c.DedupStats(); stats.Files != 3 || stats.UniqueContents != 2 || stats.LogicalBytes != 17 || stats.StoredBytes != 11 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if &foo.Content()[0] != &bar.Content()[0] {
+		t.Errorf("expected identical content to be shared")
+	}
+
+	if err := c.Delete(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Update(newFile("bar", "changed")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := c.DedupStats(); stats.UniqueContents != 2 || stats.Ratio() != 1 {
+		t.Errorf("expected shared content to be freed, got %+v", stats)
+	}
+}
+
+// collidingFile is the file with the fixed digest, it simulates the collision of the non-cryptographic hash.
+type collidingFile struct {
+	testFile
+}
+
+func (f *collidingFile) Digest() types.Digest {
+	return types.Digest("xxhash:0000000000000000")
+}
+
+func (f *collidingFile) ResidentContent() ([]byte, bool) {
+	return f.content, true
+}
+
+func (f *collidingFile) ShareContent(content []byte) {
+	f.content = content
+}
+
+func Test_contentInterner_Collision(t *testing.T) {
+	i := newContentInterner()
+	foo := &collidingFile{testFile{name: "/tmp/foo", content: []byte("foo")}}
+	bar := &collidingFile{testFile{name: "/tmp/bar", content: []byte("bar")}}
+	i.intern(foo.name, foo)
+	i.intern(bar.name, bar)
+	if string(bar.content) != "bar" {
+		t.Errorf("expected the content with colliding digest not shared, got %q", string(bar.content))
+	}
+	if stats := i.stats(); stats.Files != 1 || stats.UniqueContents != 1 {
+		t.Errorf("expected only the first file interned, got %+v", stats)
+	}
+	// The release of the file that was not interned does not free the interned content
+	i.release(bar.name)
+	if stats := i.stats(); stats.Files != 1 {
+		t.Errorf("expected the interned content retained, got %+v", stats)
+	}
+}
+
+func Test_threadSafeStore_DedupHashAlgorithm(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	newFile := func(name string, algorithm types.HashAlgorithm) types.File {
+		path := filepath.Join(baseDir, name)
+		if err := ioutil.WriteFile(path, []byte("shared"), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		f, err := types.NewFileWithOptions(path, types.FileOptions{HashAlgorithm: algorithm})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return f
+	}
+
+	// The content is interned by the digest of the file algorithm
+	c := newTestStore(nil)
+	foo, bar := newFile("foo", types.XXHash), newFile("bar", types.XXHash)
+	for _, f := range []types.File{foo, bar, newFile("baz", types.SHA256)} {
+		if err := c.Add(f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := c.DedupStats(); stats.Files != 3 || stats.UniqueContents != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if &foo.Content()[0] != &bar.Content()[0] {
+		t.Errorf("expected identical content to be shared")
+	}
+}
+
+func Test_threadSafeStore_Rename(t *testing.T) {
+	c := NewIndexer(Indexers{ParentDirIndex: ParentDirIndexFunc})
+	foo := &testFile{name: "/tmp/incoming/foo", content: []byte("foo")}
+	if err := c.Add(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w, err := c.Watch(c.Revision())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	moved := &testFile{name: "/tmp/processed/foo", content: []byte("foo")}
+	stored, err := c.Rename(foo, moved)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.(types.File).Name() != moved.name || stored.(types.File).Revision() != c.Revision() {
+		t.Errorf("expected %q stored at revision %d, got %q at %d", moved.name, c.Revision(), stored.(types.File).Name(), stored.(types.File).Revision())
+	}
+	if _, exists, _ := c.GetByKey(foo.name); exists {
+		t.Errorf("expected %q to be moved", foo.name)
+	}
+	if keys, _ := c.IndexKeys(ParentDirIndex, "/tmp/processed"); !reflect.DeepEqual(keys, []string{moved.name}) {
+		t.Errorf("expected %q indexed in the new directory, got %v", moved.name, keys)
+	}
+	if keys, _ := c.IndexKeys(ParentDirIndex, "/tmp/incoming"); len(keys) != 0 {
+		t.Errorf("expected no files indexed in the old directory, got %v", keys)
+	}
+	event := <-w.ResultChan()
+	if event.Type != Renamed || event.Object.(types.File).Name() != moved.name || event.OldObject.(types.File).Name() != foo.name {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if _, err := c.Rename(foo, moved); err == nil {
+		t.Errorf("expected error renaming the file that is not stored")
+	}
+}
+
+func Test_threadSafeStore_ReleaseContent(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	path := filepath.Join(baseDir, "foo")
+	contentCache := types.NewContentCache(1024)
+	options := types.FileOptions{ContentCache: contentCache}
+	store := NewIndexerWithOptions(Options{WatchHistorySize: 1, History: HistoryOptions{MaxVersions: 2}})
+	var versions []types.File
+	for _, content := range []string{"foo", "updated foo", "third foo"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		f, err := types.NewFileWithOptions(path, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := store.Add(f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		versions = append(versions, f)
+	}
+	// The replaced version retained in the history keeps its content although the file changed on disk
+	if content, err := versions[1].ReadContent(); err != nil || string(content) != "updated foo" {
+		t.Errorf("expected the retained version content, got %q (%v)", content, err)
+	}
+	if obj, _, err := store.GetAtRevision(path, 2); err != nil || string(obj.(types.File).Content()) != "updated foo" {
+		t.Errorf("expected the content at revision 2, got %v", err)
+	}
+	// The first version left both the history and the watch window
+	if stats := contentCache.Stats(); stats.Files != 2 {
+		t.Errorf("expected the first version evicted, got %+v", stats)
+	}
+	if _, err := versions[0].ReadContent(); errors.Cause(err) != types.ErrContentChanged {
+		t.Errorf("expected ErrContentChanged for the released version, got %v", err)
+	}
+
+	if err := store.Delete(&testFile{name: path}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Add(&testFile{name: filepath.Join(baseDir, "other")}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// The history retains the last version of the deleted file
+	if stats := contentCache.Stats(); stats.Files != 1 {
+		t.Errorf("expected only the last version retained, got %+v", stats)
+	}
+	if content, err := versions[2].ReadContent(); err != nil || string(content) != "third foo" {
+		t.Errorf("expected the deleted version content, got %q (%v)", content, err)
+	}
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// EventType is the type of the store mutation.
+type EventType string
+
+const (
+	Added    EventType = "ADDED"
+	Updated  EventType = "UPDATED"
+	Deleted  EventType = "DELETED"
+	Replaced EventType = "REPLACED"
+	// Renamed is the move of the file to other key, the OldObject is the file before the move.
+	Renamed EventType = "RENAMED"
+	// Error is the last event sent before the watch is closed because of error.
+	Error EventType = "ERROR"
+)
+
+// Event is the store mutation observed by the watch. The files of the retained events do not hold their
+// content (see types.WithoutContent), the content of the retained file versions is available by
+// Store.GetAtRevision.
+type Event struct {
+	Type EventType
+	// Revision is the store revision after the mutation
+	Revision uint64
+
+	// Object is the added or updated file or the deleted file
+	Object interface{}
+	// OldObject is the file before the update or rename
+	OldObject interface{}
+	// Objects are all files in the store after Replace
+	Objects []interface{}
+
+	// Err is set for Error events
+	Err error
+}
+
+// WatchInterface streams the store events until stopped.
+type WatchInterface interface {
+	// ResultChan returns the channel with the events. The channel is closed when the watch is stopped or
+	// after the Error event.
+	ResultChan() <-chan Event
+	Stop()
+}
+
+// ErrRevisionTooOld is returned when the events after the requested revision are no longer retained
+// in the history. The consumer must relist the store and watch from the store revision.
+var ErrRevisionTooOld = errors.New("revision is too old, relist required")
+
+// DefaultWatchHistorySize is the number of the store events retained for resuming the watch.
+const DefaultWatchHistorySize = 1000
+
+// WatchFromOldest is the revision that makes the watch stream all events retained in the history.
+const WatchFromOldest uint64 = 0
+
+// watchHistory keeps the recent store events. Must be guarded by the store lock.
+type watchHistory struct {
+	size   int
+	events []Event
+	// start is the revision before the oldest retained event, the watch can resume from any revision after it
+	start uint64
+	// changed is closed and replaced on every recorded event to wake up the watchers
+	changed chan struct{}
+	// refs retains the content of the file versions while their events are retained
+	refs contentRefs
+}
+
+func newWatchHistory(size int, refs contentRefs) *watchHistory {
+	if size <= 0 {
+		size = DefaultWatchHistorySize
+	}
+	return &watchHistory{size: size, changed: make(chan struct{}), refs: refs}
+}
+
+func (h *watchHistory) record(event Event) {
+	// The retained events would otherwise keep the content of every file version in the window
+	event = event.withoutContent()
+	event.files(h.refs.retain)
+	h.events = append(h.events, event)
+	// Trim in batches to avoid copying the history on every event
+	if len(h.events) > 2*h.size {
+		h.start = h.events[len(h.events)-h.size-1].Revision
+		for _, dropped := range h.events[:len(h.events)-h.size] {
+			dropped.files(h.refs.release)
+		}
+		h.events = append([]Event(nil), h.events[len(h.events)-h.size:]...)
+	}
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// files calls the fn for every file of the event.
+func (e Event) files(fn func(obj interface{})) {
+	for _, obj := range append([]interface{}{e.Object, e.OldObject}, e.Objects...) {
+		if obj != nil {
+			fn(obj)
+		}
+	}
+}
+
+// withoutContent returns the event with the files that do not hold their content.
+func (e Event) withoutContent() Event {
+	e.Object = withoutContent(e.Object)
+	e.OldObject = withoutContent(e.OldObject)
+	if e.Objects != nil {
+		objects := make([]interface{}, len(e.Objects))
+		for i := range e.Objects {
+			objects[i] = withoutContent(e.Objects[i])
+		}
+		e.Objects = objects
+	}
+	return e
+}
+
+func withoutContent(obj interface{}) interface{} {
+	if f, ok := obj.(types.File); ok {
+		return types.WithoutContent(f)
+	}
+	return obj
+}
+
+// since returns the events after the revision
+func (h *watchHistory) since(revision uint64) ([]Event, error) {
+	if revision < h.start {
+		return nil, errors.Wrapf(ErrRevisionTooOld, "revision %d", revision)
+	}
+	i := sort.Search(len(h.events), func(i int) bool { return h.events[i].Revision > revision })
+	return append([]Event(nil), h.events[i:]...), nil
+}
+
+type storeWatcher struct {
+	result   chan Event
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *storeWatcher) ResultChan() <-chan Event {
+	return w.result
+}
+
+func (w *storeWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stopCh) })
+}
+
+// Watch returns the stream of store events after the given revision. WatchFromOldest (zero) streams all events
+// retained in the history, the current store revision streams only future events.
+func (c *threadSafeStore) Watch(fromRevision uint64) (WatchInterface, error) {
+	c.lock.RLock()
+	if fromRevision == WatchFromOldest {
+		fromRevision = c.history.start
+	}
+	_, err := c.history.since(fromRevision)
+	c.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	w := &storeWatcher{
+		result: make(chan Event, 100),
+		stopCh: make(chan struct{}),
+	}
+	go c.runWatcher(w, fromRevision)
+	return w, nil
+}
+
+// runWatcher sends the events from history to the watcher. A watcher that falls behind the history receives
+// the ErrRevisionTooOld error.
+func (c *threadSafeStore) runWatcher(w *storeWatcher, last uint64) {
+	defer close(w.result)
+	for {
+		c.lock.RLock()
+		events, err := c.history.since(last)
+		changed := c.history.changed
+		c.lock.RUnlock()
+		if err != nil {
+			select {
+			case w.result <- Event{Type: Error, Revision: last, Err: err}:
+			case <-w.stopCh:
+			}
+			return
+		}
+		for _, event := range events {
+			select {
+			case w.result <- event:
+				last = event.Revision
+			case <-w.stopCh:
+				return
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-w.stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func receiveEvent(t *testing.T, w WatchInterface) Event {
+	select {
+	case event, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatalf("watch closed unexpectedly")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for watch event")
+	}
+	return Event{}
+}
+
+func TestStoreWatch(t *testing.T) {
+	c := NewStore()
+	foo := &testFile{name: "/tmp/foo", content: []byte("foo")}
+	if err := c.Add(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w, err := c.Watch(c.Revision())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	if err := c.Update(&testFile{name: "/tmp/foo", content: []byte("updated foo")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Delete(foo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Replace([]interface{}{foo}, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []struct {
+		eventType EventType
+		revision  uint64
+	}{{Updated, 2}, {Deleted, 3}, {Replaced, 4}} {
+		event := receiveEvent(t, w)
+		if event.Type != want.eventType || event.Revision != want.revision {
+			t.Errorf("expected %s at revision %d, got %s at %d", want.eventType, want.revision, event.Type, event.Revision)
+		}
+	}
+
+	// Resume from the past revision
+	resumed, err := c.Watch(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resumed.Stop()
+	if event := receiveEvent(t, resumed); event.Type != Updated || event.OldObject == nil {
+		t.Errorf("expected update with old object, got %#v", event)
+	}
+}
+
+func TestStoreWatchFromOldest(t *testing.T) {
+	c := NewIndexerWithOptions(Options{WatchHistorySize: 2})
+	if err := c.Add(&testFile{name: "/tmp/foo"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w, err := c.Watch(WatchFromOldest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event := receiveEvent(t, w); event.Type != Added || event.Revision != 1 {
+		t.Errorf("expected add at revision 1, got %s at %d", event.Type, event.Revision)
+	}
+	w.Stop()
+
+	// The oldest retained event is streamed after the history was trimmed
+	for i := 0; i < 10; i++ {
+		if err := c.Update(&testFile{name: "/tmp/foo"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	w, err = c.Watch(WatchFromOldest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+	event := receiveEvent(t, w)
+	if event.Type != Updated || event.Revision <= 1 || event.Revision > c.Revision()-1 {
+		t.Errorf("expected the oldest retained update, got %s at %d", event.Type, event.Revision)
+	}
+}
+
+func TestStoreWatchTooOld(t *testing.T) {
+	c := NewIndexerWithOptions(Options{WatchHistorySize: 2})
+	for i := 0; i < 10; i++ {
+		if err := c.Add(&testFile{name: "/tmp/foo"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := c.Watch(1); errors.Cause(err) != ErrRevisionTooOld {
+		t.Errorf("expected ErrRevisionTooOld, got %v", err)
+	}
+	w, err := c.Watch(c.Revision() - 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+	if event := receiveEvent(t, w); event.Revision != c.Revision() {
+		t.Errorf("expected event at revision %d, got %d", c.Revision(), event.Revision)
+	}
+}
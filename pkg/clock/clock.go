@@ -0,0 +1,69 @@
+package clock
+
+import "time"
+
+// Clock provides the time to the informer, so the tests can control the resync and the quiet periods.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// NewTicker returns the ticker that ticks with the period. The ticks are dropped when the receiver is
+	// not ready, like with time.Ticker.
+	NewTicker(period time.Duration) Ticker
+	// AfterFunc calls the function once the duration elapses.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker is the ticker created by the Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is the timer created by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false when the timer already fired or was stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+// Real returns the clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+// Default returns the real clock when the clock is not set.
+func Default(c Clock) Clock {
+	if c == nil {
+		return Real()
+	}
+	return c
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) NewTicker(period time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(period)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is the clock that advances only when told to. The timers and tickers expire synchronously in Advance,
+// so the test can step through the resync periods without sleeping.
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is the pending timer or ticker.
+type fakeWaiter struct {
+	clock    *Fake
+	deadline time.Time
+	// period is set for the tickers
+	period time.Duration
+	ch     chan time.Time
+	f      func()
+}
+
+var _ Clock = &Fake{}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *Fake) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *Fake) NewTicker(period time.Duration) Ticker {
+	if period <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{clock: c, deadline: c.now.Add(period), period: period, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{w}
+}
+
+// AfterFunc calls the function in the Advance that moves the clock past the duration.
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{clock: c, deadline: c.now.Add(d), f: f}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// Waiters returns the number of pending timers and tickers. The tests use it to wait until the code under
+// test creates its timers before advancing the clock.
+func (c *Fake) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// Advance moves the clock forward and fires the expired timers and tickers in the order of their deadlines.
+// The timers created by the fired functions fire as well when they expire within the duration.
+func (c *Fake) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].deadline.Before(c.waiters[j].deadline) })
+		if len(c.waiters) == 0 || c.waiters[0].deadline.After(target) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.deadline
+		if w.period > 0 {
+			w.deadline = w.deadline.Add(w.period)
+			select {
+			case w.ch <- c.now:
+			default:
+			}
+			continue
+		}
+		c.waiters = c.waiters[1:]
+		c.mutex.Unlock()
+		w.f()
+		c.mutex.Lock()
+	}
+	c.now = target
+	c.mutex.Unlock()
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	for i, waiter := range w.clock.waiters {
+		if waiter == w {
+			w.clock.waiters = append(w.clock.waiters[:i], w.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
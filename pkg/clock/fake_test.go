@@ -0,0 +1,59 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	var fired []time.Time
+	c.AfterFunc(2*time.Second, func() {
+		fired = append(fired, c.Now())
+		// The timer created by the fired function expires within the same advance
+		c.AfterFunc(time.Second, func() { fired = append(fired, c.Now()) })
+	})
+	stopped := c.AfterFunc(time.Second, func() { t.Errorf("stopped timer fired") })
+	if !stopped.Stop() {
+		t.Errorf("expected the timer stopped")
+	}
+	ticker := c.NewTicker(time.Second)
+	if waiters := c.Waiters(); waiters != 2 {
+		t.Errorf("expected 2 waiters, got %d", waiters)
+	}
+
+	c.Advance(time.Second)
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(start.Add(time.Second)) {
+			t.Errorf("unexpected tick time %v", tick)
+		}
+	default:
+		t.Fatalf("expected tick")
+	}
+	if len(fired) != 0 {
+		t.Errorf("expected no timers fired, got %v", fired)
+	}
+
+	// The ticks are dropped when not received
+	c.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Errorf("expected the ticks dropped")
+	default:
+	}
+	if expected := []time.Time{start.Add(2 * time.Second), start.Add(3 * time.Second)}; len(fired) != 2 || !fired[0].Equal(expected[0]) || !fired[1].Equal(expected[1]) {
+		t.Errorf("expected timers fired at %v, got %v", expected, fired)
+	}
+	if now := c.Now(); !now.Equal(start.Add(6 * time.Second)) {
+		t.Errorf("unexpected time %v", now)
+	}
+
+	ticker.Stop()
+	if waiters := c.Waiters(); waiters != 0 {
+		t.Errorf("expected no waiters, got %d", waiters)
+	}
+}
@@ -0,0 +1,148 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// Diff describes the difference between two versions of a file.
+type Diff struct {
+	Name string
+
+	// Unified is the unified line diff of text content. It is empty when any of the versions is larger than
+	// maxLineDiffSize, the changes are then summarized in Ranges.
+	Unified string
+
+	// Binary is true when any of the versions is not text content, the changes are then summarized in
+	// Ranges.
+	Binary bool
+	Ranges []ByteRange
+
+	// Changes are the path-level changes of recognized structured content (YAML, JSON). The documents of
+	// multi-document YAML are compared by their index (eg. "[1].spec.replicas").
+	Changes []Change
+}
+
+// ByteRange is the range of bytes that differ between the versions. When the content size changed, the last
+// range covers the tail of the longer version.
+type ByteRange struct {
+	Offset int
+	Length int
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("[%d-%d)", r.Offset, r.Offset+r.Length)
+}
+
+// Files returns the diff between the old and new version of the file.
+func Files(oldFile, newFile types.File) (*Diff, error) {
+	oldContent, err := oldFile.ReadContent()
+	if err != nil {
+		return nil, err
+	}
+	newContent, err := newFile.ReadContent()
+	if err != nil {
+		return nil, err
+	}
+	return Content(newFile.Name(), oldContent, newContent), nil
+}
+
+// Content returns the diff between the old and new content of the named file. The name is used to recognize
+// the structured content format.
+func Content(name string, oldContent, newContent []byte) *Diff {
+	d := &Diff{Name: name}
+	if isBinary(oldContent) || isBinary(newContent) {
+		d.Binary = true
+		d.Ranges = byteRanges(oldContent, newContent)
+		return d
+	}
+	if len(oldContent) > maxLineDiffSize || len(newContent) > maxLineDiffSize {
+		d.Ranges = byteRanges(oldContent, newContent)
+	} else {
+		d.Unified = unified(name, splitLines(string(oldContent)), splitLines(string(newContent)))
+	}
+	if format := detectFormat(name, oldContent, newContent); format != formatUnknown {
+		// Content that does not parse (eg. partially written file) has only the line diff
+		if changes, err := structuredChanges(format, oldContent, newContent); err == nil {
+			d.Changes = changes
+		}
+	}
+	return d
+}
+
+// String returns the human readable summary of the diff. It prefers the structured changes over the line
+// diff.
+func (d *Diff) String() string {
+	switch {
+	case d.Binary:
+		ranges := make([]string, 0, len(d.Ranges))
+		for _, r := range d.Ranges {
+			ranges = append(ranges, r.String())
+		}
+		return fmt.Sprintf("binary content of %s differs at %s", d.Name, strings.Join(ranges, ", "))
+	case len(d.Changes) == 0 && len(d.Unified) == 0 && len(d.Ranges) > 0:
+		ranges := make([]string, 0, len(d.Ranges))
+		for _, r := range d.Ranges {
+			ranges = append(ranges, r.String())
+		}
+		return fmt.Sprintf("content of %s differs at %s", d.Name, strings.Join(ranges, ", "))
+	case len(d.Changes) > 0:
+		changes := make([]string, 0, len(d.Changes))
+		for _, c := range d.Changes {
+			changes = append(changes, c.String())
+		}
+		return strings.Join(changes, "\n")
+	default:
+		return d.Unified
+	}
+}
+
+// sniffLen is the length of the content inspected to detect binary content
+const sniffLen = 8000
+
+func isBinary(content []byte) bool {
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+		// do not fail on multi-byte rune cut in half
+		for i := 0; i < utf8.UTFMax && len(content) > 0 && !utf8.Valid(content); i++ {
+			content = content[:len(content)-1]
+		}
+	}
+	return bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content)
+}
+
+func byteRanges(oldContent, newContent []byte) []ByteRange {
+	var ranges []ByteRange
+	common := len(oldContent)
+	if len(newContent) < common {
+		common = len(newContent)
+	}
+	start := -1
+	for i := 0; i < common; i++ {
+		if oldContent[i] != newContent[i] {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			ranges = append(ranges, ByteRange{Offset: start, Length: i - start})
+			start = -1
+		}
+	}
+	end := len(oldContent)
+	if len(newContent) > end {
+		end = len(newContent)
+	}
+	if start < 0 && end > common {
+		start = common
+	}
+	if start >= 0 {
+		ranges = append(ranges, ByteRange{Offset: start, Length: end - start})
+	}
+	return ranges
+}
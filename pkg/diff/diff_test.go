@@ -0,0 +1,102 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		fileName    string
+		old, new    string
+		wantUnified string
+		wantChanges []string
+		wantRanges  []ByteRange
+	}{
+		{
+			name:     "text",
+			fileName: "/etc/motd",
+			old:      "a\nb\nc\nd\ne\nf\ng\nh\n",
+			new:      "a\nb\nc\nd\nE\nf\ng\nh\n",
+			wantUnified: `--- a/etc/motd
++++ b/etc/motd
+@@ -2,7 +2,7 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+`,
+		},
+		{
+			name:        "yaml",
+			fileName:    "deployment.yaml",
+			old:         "spec:\n  replicas: 2\n  image: foo\n",
+			new:         "spec:\n  replicas: 3\n  image: foo\n  paused: true\n",
+			wantChanges: []string{"spec.paused: <none> -> true", "spec.replicas: 2 -> 3"},
+		},
+		{
+			name:        "json",
+			fileName:    "config",
+			old:         `{"ports": [80, 443]}`,
+			new:         `{"ports": [8080]}`,
+			wantChanges: []string{"ports[0]: 80 -> 8080", "ports[1]: 443 -> <none>"},
+		},
+		{
+			name:        "yaml documents",
+			fileName:    "manifests.yaml",
+			old:         "kind: Service\n---\nkind: Deployment\nspec:\n  replicas: 2\n",
+			new:         "kind: Service\n---\nkind: Deployment\nspec:\n  replicas: 3\n",
+			wantChanges: []string{"[1].spec.replicas: 2 -> 3"},
+		},
+		{
+			name:     "ini",
+			fileName: "settings.ini",
+			old:      "[main]\n",
+			new:      "[main]\nkey = value\n",
+			wantUnified: `--- a/settings.ini
++++ b/settings.ini
+@@ -1 +1,2 @@
+ [main]
++key = value
+`,
+		},
+		{
+			name:       "text too large",
+			fileName:   "large.txt",
+			old:        strings.Repeat("a", maxLineDiffSize+1),
+			new:        strings.Repeat("a", maxLineDiffSize) + "b",
+			wantRanges: []ByteRange{{Offset: maxLineDiffSize, Length: 1}},
+		},
+		{
+			name:       "binary",
+			fileName:   "blob",
+			old:        "\x00\x01\x02\x03",
+			new:        "\x00\x05\x02\x03\x04",
+			wantRanges: []ByteRange{{Offset: 1, Length: 1}, {Offset: 4, Length: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Content(tt.fileName, []byte(tt.old), []byte(tt.new))
+			if len(tt.wantUnified) > 0 && d.Unified != tt.wantUnified {
+				t.Errorf("Unified = %q, want %q", d.Unified, tt.wantUnified)
+			}
+			var changes []string
+			for _, c := range d.Changes {
+				changes = append(changes, c.String())
+			}
+			if !reflect.DeepEqual(changes, tt.wantChanges) {
+				t.Errorf("Changes = %v, want %v", changes, tt.wantChanges)
+			}
+			if !reflect.DeepEqual(d.Ranges, tt.wantRanges) {
+				t.Errorf("Ranges = %v, want %v", d.Ranges, tt.wantRanges)
+			}
+		})
+	}
+}
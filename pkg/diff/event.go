@@ -0,0 +1,23 @@
+package diff
+
+import "github.com/mfojtik/fsinformer/pkg/types"
+
+// FileWithDiff is the new file passed to the OnUpdate handlers when the informer attach the diffs, so every
+// handler does not need to compute it.
+type FileWithDiff struct {
+	types.File
+	Diff *Diff
+}
+
+func (f *FileWithDiff) Unwrap() types.File {
+	return f.File
+}
+
+// FromObject returns the diff attached to the new object passed to OnUpdate.
+func FromObject(obj interface{}) (*Diff, bool) {
+	f, ok := obj.(*FileWithDiff)
+	if !ok || f.Diff == nil {
+		return nil, false
+	}
+	return f.Diff, true
+}
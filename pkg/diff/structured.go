@@ -0,0 +1,228 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ChangeType string
+
+const (
+	ChangeAdded    ChangeType = "added"
+	ChangeRemoved  ChangeType = "removed"
+	ChangeModified ChangeType = "modified"
+)
+
+// Change is the change of a value in structured content.
+type Change struct {
+	Type ChangeType
+	// Path is the dot separated path to the changed value (eg. "spec.containers[0].image")
+	Path string
+	// Old and New values, the Old is nil for added values and New is nil for removed values
+	Old interface{}
+	New interface{}
+}
+
+// String returns the change in "spec.replicas: 2 -> 3" form.
+func (c Change) String() string {
+	path := c.Path
+	if len(path) == 0 {
+		path = "."
+	}
+	return fmt.Sprintf("%s: %s -> %s", path, formatValue(c.Old, c.Type == ChangeAdded), formatValue(c.New, c.Type == ChangeRemoved))
+}
+
+func formatValue(value interface{}, missing bool) string {
+	if missing {
+		return "<none>"
+	}
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		out, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprintf("%v", value)
+		}
+		return string(out)
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+type format int
+
+const (
+	formatUnknown format = iota
+	formatJSON
+	formatYAML
+)
+
+// detectFormat returns the format by the file extension. Only the content of the files without extension is
+// inspected, the other files (eg. INI files starting with "[section]") are not structured.
+func detectFormat(name string, contents ...[]byte) format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	case "":
+	default:
+		return formatUnknown
+	}
+	for _, content := range contents {
+		trimmed := bytes.TrimSpace(content)
+		if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+			return formatUnknown
+		}
+	}
+	return formatJSON
+}
+
+func structuredChanges(f format, oldContent, newContent []byte) ([]Change, error) {
+	oldDocuments, err := unmarshal(f, oldContent)
+	if err != nil {
+		return nil, err
+	}
+	newDocuments, err := unmarshal(f, newContent)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	if len(oldDocuments) > 1 || len(newDocuments) > 1 {
+		compareSlices("", oldDocuments, newDocuments, &changes)
+		return changes, nil
+	}
+	var oldValue, newValue interface{}
+	if len(oldDocuments) > 0 {
+		oldValue = oldDocuments[0]
+	}
+	if len(newDocuments) > 0 {
+		newValue = newDocuments[0]
+	}
+	compareValues("", oldValue, newValue, &changes)
+	return changes, nil
+}
+
+// unmarshal returns the documents of the content, the JSON content is a single document.
+func unmarshal(f format, content []byte) ([]interface{}, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, nil
+	}
+	if f == formatJSON {
+		var value interface{}
+		if err := json.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+		return []interface{}{normalize(value)}, nil
+	}
+	var documents []interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, normalize(value))
+	}
+}
+
+// normalize converts the YAML maps with non-string keys to map[string]interface{}
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalize(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprintf("%v", key)] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func compareValues(path string, oldValue, newValue interface{}, changes *[]Change) {
+	switch oldTyped := oldValue.(type) {
+	case map[string]interface{}:
+		if newTyped, ok := newValue.(map[string]interface{}); ok {
+			compareMaps(path, oldTyped, newTyped, changes)
+			return
+		}
+	case []interface{}:
+		if newTyped, ok := newValue.([]interface{}); ok {
+			compareSlices(path, oldTyped, newTyped, changes)
+			return
+		}
+	}
+	if !reflect.DeepEqual(oldValue, newValue) {
+		*changes = append(*changes, Change{Type: ChangeModified, Path: path, Old: oldValue, New: newValue})
+	}
+}
+
+func compareMaps(path string, oldMap, newMap map[string]interface{}, changes *[]Change) {
+	keys := make([]string, 0, len(oldMap)+len(newMap))
+	for key := range oldMap {
+		keys = append(keys, key)
+	}
+	for key := range newMap {
+		if _, ok := oldMap[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		oldItem, inOld := oldMap[key]
+		newItem, inNew := newMap[key]
+		switch {
+		case !inOld:
+			*changes = append(*changes, Change{Type: ChangeAdded, Path: joinPath(path, key), New: newItem})
+		case !inNew:
+			*changes = append(*changes, Change{Type: ChangeRemoved, Path: joinPath(path, key), Old: oldItem})
+		default:
+			compareValues(joinPath(path, key), oldItem, newItem, changes)
+		}
+	}
+}
+
+func compareSlices(path string, oldSlice, newSlice []interface{}, changes *[]Change) {
+	for i := 0; i < len(oldSlice) || i < len(newSlice); i++ {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= len(oldSlice):
+			*changes = append(*changes, Change{Type: ChangeAdded, Path: itemPath, New: newSlice[i]})
+		case i >= len(newSlice):
+			*changes = append(*changes, Change{Type: ChangeRemoved, Path: itemPath, Old: oldSlice[i]})
+		default:
+			compareValues(itemPath, oldSlice[i], newSlice[i], changes)
+		}
+	}
+}
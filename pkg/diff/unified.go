@@ -0,0 +1,193 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// contextLines is the number of unchanged lines around the changes in the unified diff
+	contextLines = 3
+	// maxEdits limits the cost of the line diff, larger changes are reported as replacement of all lines. The
+	// trace of the edits takes O(maxEdits^2) memory.
+	maxEdits = 1024
+	// maxLineDiffSize is the size of the content above which the line diff is not computed
+	maxLineDiffSize = 1 << 20
+)
+
+type editOp byte
+
+const (
+	opEqual  editOp = ' '
+	opDelete editOp = '-'
+	opInsert editOp = '+'
+)
+
+type edit struct {
+	op   editOp
+	text string
+}
+
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineEdits computes the shortest edit script using the Myers algorithm.
+func lineEdits(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds the furthest reaching x for diagonals -d..d before the step d
+	var trace [][]int
+	for d := 0; d <= max && d <= maxEdits; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	edits := make([]edit, 0, max)
+	for _, line := range a {
+		edits = append(edits, edit{op: opDelete, text: line})
+	}
+	for _, line := range b {
+		edits = append(edits, edit{op: opInsert, text: line})
+	}
+	return edits
+}
+
+func backtrack(a, b []string, trace [][]int) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{op: opEqual, text: a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			edits = append(edits, edit{op: opInsert, text: b[y-1]})
+			y--
+		} else {
+			edits = append(edits, edit{op: opDelete, text: a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, edit{op: opEqual, text: a[x-1]})
+		x, y = x-1, y-1
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// unified formats the line edits as unified diff with hunks
+func unified(name string, a, b []string) string {
+	edits := lineEdits(a, b)
+	var out strings.Builder
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(edits); {
+		if edits[i].op == opEqual {
+			i, oldLine, newLine = i+1, oldLine+1, newLine+1
+			continue
+		}
+		// The hunk starts with the context before the first change and ends when there are more than
+		// 2*contextLines unchanged lines.
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end, equalRun := i, 0
+		for end < len(edits) && equalRun <= 2*contextLines {
+			if edits[end].op == opEqual {
+				equalRun++
+			} else {
+				equalRun = 0
+			}
+			end++
+		}
+		if equalRun > contextLines {
+			end -= equalRun - contextLines
+		}
+		hunkOld, hunkNew := oldLine-(i-start), newLine-(i-start)
+		var oldCount, newCount int
+		var body strings.Builder
+		for _, e := range edits[start:end] {
+			switch e.op {
+			case opEqual:
+				oldCount++
+				newCount++
+			case opDelete:
+				oldCount++
+			case opInsert:
+				newCount++
+			}
+			body.WriteByte(byte(e.op))
+			body.WriteString(e.text)
+			if !strings.HasSuffix(e.text, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", strings.TrimPrefix(name, "/"), strings.TrimPrefix(name, "/"))
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(hunkOld, oldCount), hunkRange(hunkNew, newCount))
+		out.WriteString(body.String())
+		for _, e := range edits[i:end] {
+			if e.op != opInsert {
+				oldLine++
+			}
+			if e.op != opDelete {
+				newLine++
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,160 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/mfojtik/fsinformer/pkg/watch"
+)
+
+// FS is the filesystem the informer reads the files from. The names are the paths of the watched files; the
+// OS filesystem accepts any OS path, the filesystems backed by io/fs.FS strip the leading slash.
+type FS interface {
+	fs.FS
+
+	// Stat returns the file information following the symlinks.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat returns the file information of the name itself, which might be a symlink. Filesystems without
+	// symlinks return Stat.
+	Lstat(name string) (fs.FileInfo, error)
+	// Readlink returns the symlink target.
+	Readlink(name string) (string, error)
+}
+
+// WritableFS is the filesystem that can be modified (eg. by the rollback).
+type WritableFS interface {
+	FS
+
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldName, newName string) error
+}
+
+// OwnerFS is the writable filesystem with the file ownership.
+type OwnerFS interface {
+	WritableFS
+
+	Chown(name string, uid, gid int) error
+}
+
+// WatchableFS is the filesystem that provides its own watch backend. The informer polls the filesystems
+// that are not watchable.
+type WatchableFS interface {
+	FS
+
+	NewBackend() (watch.Backend, error)
+}
+
+// Default returns the OS filesystem when the filesystem is not set.
+func Default(fsys FS) FS {
+	if fsys == nil {
+		return OS()
+	}
+	return fsys
+}
+
+// IsOS returns true when the filesystem is not set or it is the OS filesystem.
+func IsOS(fsys FS) bool {
+	_, ok := Default(fsys).(osFS)
+	return ok
+}
+
+// WriteFile writes the file to the filesystem, which must be writable.
+func WriteFile(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	w, ok := Default(fsys).(WritableFS)
+	if !ok {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrPermission}
+	}
+	return w.WriteFile(name, data, perm)
+}
+
+// tmpCounter makes the names of the temporary files unique
+var tmpCounter uint64
+
+// WriteFileAtomic writes the data to the temporary file next to the file and renames it into place, so the
+// file is never left partially written. The filesystem must be writable.
+func WriteFileAtomic(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	return writeFileAtomic(fsys, name, data, perm, nil)
+}
+
+// WriteFileAtomicWithOwner writes the file like WriteFileAtomic and sets the ownership of the new file. The
+// ownership is set only on the filesystems implementing OwnerFS, it fails when the process is not allowed to
+// change the ownership.
+func WriteFileAtomicWithOwner(fsys FS, name string, data []byte, perm fs.FileMode, uid, gid int) error {
+	o, ok := Default(fsys).(OwnerFS)
+	if !ok {
+		return WriteFileAtomic(fsys, name, data, perm)
+	}
+	return writeFileAtomic(fsys, name, data, perm, func(tmp string) error {
+		return o.Chown(tmp, uid, gid)
+	})
+}
+
+func writeFileAtomic(fsys FS, name string, data []byte, perm fs.FileMode, beforeRename func(tmp string) error) error {
+	w, ok := Default(fsys).(WritableFS)
+	if !ok {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrPermission}
+	}
+	tmp := filepath.Join(filepath.Dir(name), fmt.Sprintf(".%s.%d-%d.tmp", filepath.Base(name), os.Getpid(), atomic.AddUint64(&tmpCounter, 1)))
+	if err := w.WriteFile(tmp, data, perm); err != nil {
+		w.Remove(tmp)
+		return err
+	}
+	if beforeRename != nil {
+		if err := beforeRename(tmp); err != nil {
+			w.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Rename(tmp, name); err != nil {
+		w.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+type osFS struct{}
+
+// OS returns the filesystem of the operating system.
+func OS() FS {
+	return osFS{}
+}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
@@ -0,0 +1,100 @@
+package filesystem
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOverlay(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "app.yaml"), []byte("user"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	defaults := FromIOFS(fstest.MapFS{
+		"app.yaml":      {Data: []byte("default")},
+		"defaults.yaml": {Data: []byte("default")},
+	})
+	overlay := Overlay(Dir(baseDir), defaults)
+
+	tests := []struct {
+		name            string
+		expectedContent string
+		expectNotExist  bool
+	}{
+		{name: "/app.yaml", expectedContent: "user"},
+		{name: "/defaults.yaml", expectedContent: "default"},
+		{name: "/missing.yaml", expectNotExist: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, err := fs.ReadFile(overlay, test.name)
+			if test.expectNotExist {
+				if !os.IsNotExist(err) {
+					t.Fatalf("expected not exist error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(content) != test.expectedContent {
+				t.Errorf("expected %q, got %q", test.expectedContent, string(content))
+			}
+		})
+	}
+
+	entries, err := fs.ReadDir(overlay, "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if expected := []string{"app.yaml", "defaults.yaml"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected entries %v, got %v", expected, names)
+	}
+
+	if err := WriteFile(overlay, "/defaults.yaml", []byte("user"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(baseDir, "defaults.yaml")); err != nil || string(content) != "user" {
+		t.Errorf("expected the write in the upper layer, got %q (%v)", string(content), err)
+	}
+	if err := WriteFile(defaults, "/app.yaml", []byte("user"), 0644); !os.IsPermission(err) {
+		t.Errorf("expected permission error writing read-only filesystem, got %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	dir := Dir(baseDir)
+	for _, content := range []string{"foo", "updated"} {
+		if err := WriteFileAtomic(dir, "/foo", []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if content, err := fs.ReadFile(dir, "/foo"); err != nil || string(content) != "updated" {
+		t.Errorf("expected updated content, got %q (%v)", string(content), err)
+	}
+	// The temporary files are renamed into place
+	if entries, err := fs.ReadDir(dir, "/"); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the written file, got %v (%v)", entries, err)
+	}
+	if err := WriteFileAtomic(FromIOFS(fstest.MapFS{}), "/foo", nil, 0644); !os.IsPermission(err) {
+		t.Errorf("expected permission error writing read-only filesystem, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package filesystem
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+// FromIOFS returns the read-only filesystem backed by io/fs.FS (eg. embed.FS with the default files). The
+// leading slash of the names is stripped. The io/fs.FS does not support symlinks.
+func FromIOFS(fsys fs.FS) FS {
+	return &ioFS{fsys: fsys}
+}
+
+// ioName converts the name to the io/fs path.
+func ioName(name string) string {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	if len(name) == 0 {
+		return "."
+	}
+	return name
+}
+
+func (f *ioFS) Open(name string) (fs.File, error) {
+	return f.fsys.Open(ioName(name))
+}
+
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(f.fsys, ioName(name))
+}
+
+func (f *ioFS) Lstat(name string) (fs.FileInfo, error) {
+	return f.Stat(name)
+}
+
+func (f *ioFS) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(f.fsys, ioName(name))
+}
+
+type dirFS struct {
+	root string
+}
+
+// Dir returns the OS filesystem rooted at the directory. The names are relative to the root.
+func Dir(root string) FS {
+	return &dirFS{root: root}
+}
+
+func (d *dirFS) join(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(ioName(name)))
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	return OS().Open(d.join(name))
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	return OS().Stat(d.join(name))
+}
+
+func (d *dirFS) Lstat(name string) (fs.FileInfo, error) {
+	return OS().Lstat(d.join(name))
+}
+
+func (d *dirFS) Readlink(name string) (string, error) {
+	return OS().Readlink(d.join(name))
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(OS(), d.join(name))
+}
+
+func (d *dirFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return WriteFile(OS(), d.join(name), data, perm)
+}
+
+func (d *dirFS) Remove(name string) error {
+	return OS().(WritableFS).Remove(d.join(name))
+}
+
+func (d *dirFS) Rename(oldName, newName string) error {
+	return OS().(WritableFS).Rename(d.join(oldName), d.join(newName))
+}
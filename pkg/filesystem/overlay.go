@@ -0,0 +1,117 @@
+package filesystem
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+)
+
+type overlayFS struct {
+	layers []FS
+}
+
+// Overlay returns the filesystem that reads the file from the first layer that has it (eg. the user
+// configuration over the embedded defaults). The writes go to the first layer.
+func Overlay(layers ...FS) FS {
+	return &overlayFS{layers: layers}
+}
+
+// layer returns the first layer where the name exists.
+func (o *overlayFS) layer(name string) (FS, error) {
+	for _, l := range o.layers {
+		if _, err := l.Lstat(name); err == nil {
+			return l, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	l, err := o.layer(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.Open(name)
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	l, err := o.layer(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.Stat(name)
+}
+
+func (o *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	l, err := o.layer(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lstat(name)
+}
+
+func (o *overlayFS) Readlink(name string) (string, error) {
+	l, err := o.layer(name)
+	if err != nil {
+		return "", err
+	}
+	return l.Readlink(name)
+}
+
+// ReadDir merges the entries of all layers, the entries of upper layers hide the entries of lower layers.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	found := false
+	for i := len(o.layers) - 1; i >= 0; i-- {
+		layerEntries, err := fs.ReadDir(o.layers[i], name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range layerEntries {
+			entries[entry.Name()] = entry
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+func (o *overlayFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if len(o.layers) == 0 {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrPermission}
+	}
+	return WriteFile(o.layers[0], name, data, perm)
+}
+
+func (o *overlayFS) Remove(name string) error {
+	if len(o.layers) == 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	w, ok := o.layers[0].(WritableFS)
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return w.Remove(name)
+}
+
+func (o *overlayFS) Rename(oldName, newName string) error {
+	if len(o.layers) == 0 {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+	w, ok := o.layers[0].(WritableFS)
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrPermission}
+	}
+	return w.Rename(oldName, newName)
+}
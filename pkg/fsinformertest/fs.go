@@ -0,0 +1,341 @@
+package fsinformertest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+var _ filesystem.WritableFS = &MemFS{}
+
+// MemFS is the in-memory filesystem with flat namespace of files. The directories exist implicitly as long
+// as they contain a file. It implements filesystem.WritableFS and it is safe for concurrent use.
+type MemFS struct {
+	clock clock.Clock
+
+	mutex       sync.RWMutex
+	files       map[string]*memEntry
+	lastInode   uint64
+	lastModTime time.Time
+}
+
+type memEntry struct {
+	content []byte
+	mode    os.FileMode
+	modTime time.Time
+	inode   uint64
+}
+
+// NewMemFS returns the empty filesystem. The modification times are taken from the clock.
+func NewMemFS(c clock.Clock) *MemFS {
+	return &MemFS{clock: clock.Default(c), files: map[string]*memEntry{}}
+}
+
+// WriteFile creates or replaces the file content. The mode is used only when the file is created.
+func (m *MemFS) WriteFile(name string, content []byte, mode os.FileMode) error {
+	name = filepath.Clean(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, exists := m.files[name]
+	if !exists {
+		m.lastInode++
+		entry = &memEntry{mode: mode, inode: m.lastInode}
+		m.files[name] = entry
+	}
+	entry.content = append([]byte(nil), content...)
+	// Every write gets the unique modification time, so the writes are observed by comparing the metadata
+	// even when the clock does not move.
+	entry.modTime = m.clock.Now()
+	if !entry.modTime.After(m.lastModTime) {
+		entry.modTime = m.lastModTime.Add(time.Nanosecond)
+	}
+	m.lastModTime = entry.modTime
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	name = filepath.Clean(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, exists := m.files[name]
+	if !exists {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	entry.mode = mode
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.files[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Rename moves the file, the file at the new name is replaced.
+func (m *MemFS) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, exists := m.files[oldName]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = entry
+	return nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.NewFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Content(), nil
+}
+
+// List returns the names of all files, sorted.
+func (m *MemFS) List() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the file for reading. The directories can be listed only by ReadDir.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	f, err := m.NewFile(name)
+	if err != nil {
+		if _, statErr := m.Stat(name); statErr == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		}
+		return nil, err
+	}
+	return &memOpenFile{Reader: bytes.NewReader(f.Content()), info: f.Stat()}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if entry, exists := m.files[name]; exists {
+		return entry.info(name), nil
+	}
+	for file := range m.files {
+		if isParentDir(name, file) {
+			return &memFileInfo{name: filepath.Base(name), mode: fs.ModeDir | 0755, dir: true}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// Lstat returns Stat, MemFS has no symlinks.
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+// ReadDir returns the files and implicit directories in the directory, sorted by name.
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	children := map[string]fs.FileInfo{}
+	for file, entry := range m.files {
+		if !isParentDir(name, file) {
+			continue
+		}
+		rel, err := filepath.Rel(name, file)
+		if err != nil {
+			continue
+		}
+		if parts := strings.SplitN(rel, string(filepath.Separator), 2); len(parts) > 1 {
+			children[parts[0]] = &memFileInfo{name: parts[0], mode: fs.ModeDir | 0755, dir: true}
+		} else {
+			children[rel] = entry.info(file)
+		}
+	}
+	if len(children) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// isParentDir returns true when the file is anywhere below the directory.
+func isParentDir(dir, file string) bool {
+	if dir == file {
+		return false
+	}
+	if dir == string(filepath.Separator) || dir == "." {
+		return true
+	}
+	return strings.HasPrefix(file, dir+string(filepath.Separator))
+}
+
+// NewFile returns the current version of the file. The returned file does not change when the file is
+// modified later.
+func (m *MemFS) NewFile(name string) (types.File, error) {
+	name = filepath.Clean(name)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, exists := m.files[name]
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	digest, err := types.ComputeDigest(types.SHA256, bytes.NewReader(entry.content))
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{
+		name:    name,
+		info:    entry.info(name),
+		inode:   entry.inode,
+		content: entry.content,
+		digest:  digest,
+	}, nil
+}
+
+func (e *memEntry) info(name string) *memFileInfo {
+	return &memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(e.content)),
+		mode:    e.mode,
+		modTime: e.modTime,
+		inode:   e.inode,
+	}
+}
+
+// memOpenFile is the file opened by MemFS.Open.
+type memOpenFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *memOpenFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memOpenFile) Close() error {
+	return nil
+}
+
+// memFile is the version of the file in MemFS.
+type memFile struct {
+	name    string
+	info    *memFileInfo
+	inode   uint64
+	content []byte
+	digest  types.Digest
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() os.FileInfo {
+	return f.info
+}
+
+func (f *memFile) Lstat() os.FileInfo {
+	return f.info
+}
+
+func (f *memFile) Metadata() types.Metadata {
+	return types.Metadata{
+		Size:    f.info.size,
+		ModTime: f.info.modTime,
+		Mode:    f.info.mode,
+		Inode:   f.inode,
+	}
+}
+
+func (f *memFile) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+func (f *memFile) Content() []byte {
+	return f.content
+}
+
+func (f *memFile) ReadContent() ([]byte, error) {
+	return f.content, nil
+}
+
+func (f *memFile) Digest() types.Digest {
+	return f.digest
+}
+
+func (f *memFile) ContentSum256() string {
+	return f.digest.Hex()
+}
+
+func (f *memFile) Revision() uint64 {
+	return 0
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	inode   uint64
+	dir     bool
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.dir
+}
+
+// Sys returns the inode of the file, see types.InodeFileInfo.
+func (i *memFileInfo) Sys() interface{} {
+	return memInode(i.inode)
+}
+
+type memInode uint64
+
+func (i memInode) Inode() uint64 {
+	return uint64(i)
+}
@@ -0,0 +1,233 @@
+package fsinformertest
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/informer"
+	"github.com/mfojtik/fsinformer/pkg/types"
+	"github.com/mfojtik/fsinformer/pkg/watch"
+)
+
+// FakeInformer is the informer over the in-memory filesystem, driven by the test. It runs the file informer
+// with the MemFS and the fake clock, so the changes are handled the same way: the changes made through the
+// FakeInformer are observed by the informer relist and delivered to the handlers before the method returns.
+// The changes made directly in the FS are observed by the Resync, which also runs when the Clock advances
+// past the resync period. The groups are delivered when the Clock advances past their quiet period.
+//
+// The methods changing the files must not be called from the handlers. The handlers must be added before Run.
+type FakeInformer struct {
+	FS    *MemFS
+	Clock *clock.Fake
+
+	resyncPeriod time.Duration
+	paths        []string
+
+	// mutex guards the informer and the handlers registered before Run
+	mutex         sync.Mutex
+	informer      informer.FileInformer
+	handlers      []types.FileEventHandlerFuncs
+	groups        []types.FileGroup
+	groupHandlers []types.FileGroupEventHandlerFuncs
+	stopCh        <-chan struct{}
+}
+
+var _ informer.FileInformer = &FakeInformer{}
+
+// NewFakeInformer returns the informer watching the given paths in the empty in-memory filesystem. When no
+// paths are given, all files in the filesystem are watched, including the files added after Run.
+func NewFakeInformer(resyncPeriod time.Duration, paths ...string) *FakeInformer {
+	fakeClock := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cleanPaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		cleanPaths = append(cleanPaths, filepath.Clean(path))
+	}
+	return &FakeInformer{
+		FS:           NewMemFS(fakeClock),
+		Clock:        fakeClock,
+		resyncPeriod: resyncPeriod,
+		paths:        cleanPaths,
+	}
+}
+
+// AddEventHandler adds the handler. It panics when called after Run, as the file informer does.
+func (f *FakeInformer) AddEventHandler(handler types.FileEventHandlerFuncs) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.informer != nil {
+		panic("cannot add handler funcs when started")
+	}
+	f.handlers = append(f.handlers, handler)
+}
+
+// AddGroupEventHandler adds the group handler. It panics when called after Run, as the file informer does.
+func (f *FakeInformer) AddGroupEventHandler(group types.FileGroup, handler types.FileGroupEventHandlerFuncs) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.informer != nil {
+		panic("cannot add group handler funcs when started")
+	}
+	f.groups = append(f.groups, group)
+	f.groupHandlers = append(f.groupHandlers, handler)
+}
+
+// Run starts the informer and returns after the OnAdd handlers for the existing files ran. It panics when the
+// informer can't be created (eg. the watched path is a directory).
+func (f *FakeInformer) Run(stopCh <-chan struct{}) {
+	// Without paths, the files added later are watched by the next relist
+	var listPaths func() []string
+	if len(f.paths) == 0 {
+		listPaths = f.FS.List
+	}
+	// The informer is resynced by the FakeInformer, so the resync happens in the Clock advance
+	fileInformer, err := informer.NewFileInformerWithConfig(informer.Config{
+		Paths:     f.paths,
+		ListPaths: listPaths,
+		FS:        f.FS,
+		Clock:     f.Clock,
+		NewBackend: func() (watch.Backend, error) {
+			return newNopBackend(), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	f.mutex.Lock()
+	for _, handler := range f.handlers {
+		fileInformer.AddEventHandler(handler)
+	}
+	for i, group := range f.groups {
+		fileInformer.AddGroupEventHandler(group, f.groupHandlers[i])
+	}
+	fileInformer.Run(stopCh)
+	f.informer, f.stopCh = fileInformer, stopCh
+	f.mutex.Unlock()
+
+	// Wait for the initial relist
+	fileInformer.Resync()
+	if f.resyncPeriod > 0 {
+		f.Clock.AfterFunc(f.resyncPeriod, f.resyncTick)
+	}
+}
+
+func (f *FakeInformer) resyncTick() {
+	select {
+	case <-f.stopCh:
+		return
+	default:
+	}
+	f.Resync()
+	f.Clock.AfterFunc(f.resyncPeriod, f.resyncTick)
+}
+
+func (f *FakeInformer) running() informer.FileInformer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.informer
+}
+
+func (f *FakeInformer) HasSynced() bool {
+	return f.running() != nil
+}
+
+// GetStore returns the informer store, nil before Run.
+func (f *FakeInformer) GetStore() cache.Store {
+	if i := f.running(); i != nil {
+		return i.GetStore()
+	}
+	return nil
+}
+
+// GetIndexer returns the informer store, nil before Run.
+func (f *FakeInformer) GetIndexer() cache.Indexer {
+	if i := f.running(); i != nil {
+		return i.GetIndexer()
+	}
+	return nil
+}
+
+func (f *FakeInformer) Metrics() informer.Metrics {
+	if i := f.running(); i != nil {
+		return i.Metrics()
+	}
+	return informer.Metrics{}
+}
+
+// Add creates the file.
+func (f *FakeInformer) Add(path string, content []byte) error {
+	if _, err := f.FS.NewFile(path); err == nil {
+		return os.ErrExist
+	}
+	if err := f.FS.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	f.Resync()
+	return nil
+}
+
+// Modify replaces the content of the existing file.
+func (f *FakeInformer) Modify(path string, content []byte) error {
+	if _, err := f.FS.NewFile(path); err != nil {
+		return err
+	}
+	if err := f.FS.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	f.Resync()
+	return nil
+}
+
+// Chmod changes the file mode.
+func (f *FakeInformer) Chmod(path string, mode os.FileMode) error {
+	if err := f.FS.Chmod(path, mode); err != nil {
+		return err
+	}
+	f.Resync()
+	return nil
+}
+
+// Delete removes the file.
+func (f *FakeInformer) Delete(path string) error {
+	if err := f.FS.Remove(path); err != nil {
+		return err
+	}
+	f.Resync()
+	return nil
+}
+
+// Rename moves the file. The move between the watched paths is delivered as OnRename, moves out of and into
+// the watched paths as OnDelete and OnAdd.
+func (f *FakeInformer) Rename(oldPath, newPath string) error {
+	if err := f.FS.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	f.Resync()
+	return nil
+}
+
+// Resync relists the watched paths and delivers the changes. It is no-op before Run.
+func (f *FakeInformer) Resync() {
+	if i := f.running(); i != nil {
+		i.Resync()
+	}
+}
+
+// nopBackend is the watch backend that reports no events, the changes are observed by the relist.
+type nopBackend struct {
+	events chan watch.Event
+	errors chan error
+}
+
+func newNopBackend() *nopBackend {
+	return &nopBackend{events: make(chan watch.Event), errors: make(chan error)}
+}
+
+func (b *nopBackend) Add(name string) error      { return nil }
+func (b *nopBackend) Remove(name string) error   { return nil }
+func (b *nopBackend) Events() <-chan watch.Event { return b.events }
+func (b *nopBackend) Errors() <-chan error       { return b.errors }
+func (b *nopBackend) Close() error               { return nil }
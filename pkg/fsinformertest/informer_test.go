@@ -0,0 +1,191 @@
+package fsinformertest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/informer"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+func TestFakeInformer(t *testing.T) {
+	informer := NewFakeInformer(time.Minute, "/etc/foo", "/etc/bar")
+	if err := informer.FS.WriteFile("/etc/foo", []byte("foo"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var events []string
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// The handlers run without holding the informer lock
+			if _, exists, _ := informer.GetStore().GetByKey(obj.(types.File).Name()); !exists {
+				t.Errorf("expected %q in store", obj.(types.File).Name())
+			}
+			events = append(events, "add "+obj.(types.File).Name())
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			events = append(events, "update "+obj.(types.File).Name()+" "+string(obj.(types.File).Content()))
+		},
+		MetadataUpdateFunc: func(old, obj interface{}) {
+			events = append(events, "chmod "+obj.(types.File).Name())
+		},
+		DeleteFunc: func(obj interface{}) {
+			events = append(events, "delete "+obj.(types.File).Name())
+		},
+		RenameFunc: func(old, obj interface{}) {
+			events = append(events, "rename "+old.(types.File).Name()+" "+obj.(types.File).Name())
+		},
+	})
+	var groupUpdates int
+	informer.AddGroupEventHandler(types.FileGroup{Name: "pair", Paths: []string{"/etc/foo", "/etc/bar"}}, types.FileGroupEventHandlerFuncs{
+		UpdateFunc: func(group string, oldFiles, newFiles map[string]types.File) {
+			groupUpdates++
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	steps := []func() error{
+		func() error { return informer.Modify("/etc/foo", []byte("updated")) },
+		func() error { return informer.Modify("/etc/foo", []byte("updated")) },
+		func() error { return informer.Chmod("/etc/foo", 0600) },
+		func() error { return informer.Rename("/etc/foo", "/etc/bar") },
+		func() error { return informer.Add("/etc/foo", []byte("foo")) },
+		func() error { return informer.Rename("/etc/foo", "/tmp/foo") },
+		func() error { return informer.Delete("/etc/bar") },
+	}
+	// The group is delivered after the quiet period
+	informer.Clock.Advance(time.Second)
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: unexpected error: %v", i, err)
+		}
+		informer.Clock.Advance(time.Second)
+	}
+	if err := informer.Delete("/etc/bar"); err == nil {
+		t.Errorf("expected error deleting the missing file")
+	}
+
+	// The files written directly to the FS are observed by the resync
+	if err := informer.FS.WriteFile("/etc/bar", []byte("bar"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	observed := len(events)
+	informer.Clock.Advance(51 * time.Second)
+	if len(events) != observed {
+		t.Errorf("unexpected resync before the resync period: %v", events[observed:])
+	}
+	// The resync and the group quiet period
+	informer.Clock.Advance(2 * time.Second)
+
+	expected := []string{
+		"add /etc/foo",
+		"update /etc/foo updated",
+		"chmod /etc/foo",
+		"rename /etc/foo /etc/bar",
+		"add /etc/foo",
+		"delete /etc/foo",
+		"delete /etc/bar",
+		"add /etc/bar",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events:\n%v\nexpected:\n%v", events, expected)
+	}
+	// The mode change is not a group update
+	if groupUpdates != 7 {
+		t.Errorf("expected group update for every content change, got %d", groupUpdates)
+	}
+}
+
+func TestFakeInformerWithoutPaths(t *testing.T) {
+	informer := NewFakeInformer(0)
+	if err := informer.FS.WriteFile("/etc/foo", []byte("foo"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var events []string
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events = append(events, "add "+obj.(types.File).Name())
+		},
+		DeleteFunc: func(obj interface{}) {
+			events = append(events, "delete "+obj.(types.File).Name())
+		},
+		RenameFunc: func(old, obj interface{}) {
+			events = append(events, "rename "+old.(types.File).Name()+" "+obj.(types.File).Name())
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+
+	// The files added after Run are watched
+	for _, step := range []func() error{
+		func() error { return informer.Add("/etc/bar", []byte("bar")) },
+		func() error { return informer.Rename("/etc/bar", "/etc/baz") },
+		func() error { return informer.Delete("/etc/foo") },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	expected := []string{"add /etc/foo", "add /etc/bar", "rename /etc/bar /etc/baz", "delete /etc/foo"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic when the handler is added after Run")
+		}
+	}()
+	informer.AddEventHandler(types.FileEventHandlerFuncs{})
+}
+
+func TestMemFSInformer(t *testing.T) {
+	memFS := NewMemFS(clock.NewFake(time.Now()))
+	if err := memFS.WriteFile("/etc/foo", []byte("foo"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fileInformer, err := informer.NewFileInformerWithConfig(informer.Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{"/etc/foo"},
+		FS:           memFS,
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	isFooObserved := make(chan struct{}, 1)
+	isFooUpdated := make(chan string, 1)
+	fileInformer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isFooObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			isFooUpdated <- string(obj.(types.File).Content())
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	fileInformer.Run(stopCh)
+	select {
+	case <-isFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for foo observed")
+	}
+	// The clock does not move, the write is still observed
+	if err := memFS.WriteFile("/etc/foo", []byte("bar"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case content := <-isFooUpdated:
+		if content != "bar" {
+			t.Errorf("expected updated content, got %q", content)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for foo update")
+	}
+}
@@ -0,0 +1,195 @@
+package informer
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// defaultQueueSize is the number of pending events per worker when the config does not set it.
+const defaultQueueSize = 100
+
+// defaultWorkers returns the number of workers used when the config does not set it.
+func defaultWorkers() int {
+	return runtime.NumCPU()
+}
+
+// newQueues returns the event queues, one per worker.
+func newQueues(workers, queueSize int) []chan func() {
+	if workers < 1 {
+		workers = defaultWorkers()
+	}
+	if queueSize < 1 {
+		queueSize = defaultQueueSize
+	}
+	queues := make([]chan func(), workers)
+	for i := range queues {
+		queues[i] = make(chan func(), queueSize)
+	}
+	return queues
+}
+
+// runWorkers starts the workers executing the dispatched events. When stopped, the workers run the events
+// that were already queued and exit, so every dispatched event is handled.
+func (f *fsHandler) runWorkers(stopCh <-chan struct{}) {
+	drainCh := make(chan struct{})
+	go func() {
+		<-stopCh
+		// Wait for the dispatches in progress, nothing is queued after this
+		f.queuesMutex.Lock()
+		f.queuesStopped = true
+		f.queuesMutex.Unlock()
+		close(drainCh)
+	}()
+	for _, queue := range f.queues {
+		go func(queue <-chan func()) {
+			for {
+				select {
+				case task := <-queue:
+					task()
+				case <-drainCh:
+					for {
+						select {
+						case task := <-queue:
+							task()
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(queue)
+	}
+}
+
+// dispatch queues the event handling. The events for the same path go to the same worker, so the handlers
+// observe them in order. When the queue is full, dispatch blocks until the worker catches up. It returns
+// false when the informer was stopped and the task will not run.
+func (f *fsHandler) dispatch(path string, task func()) bool {
+	f.queuesMutex.RLock()
+	defer f.queuesMutex.RUnlock()
+	return f.enqueue(f.queueIndex(path), task)
+}
+
+// dispatchPair queues the event handling of two paths (eg. the rename). The task runs on one of the workers
+// after the other worker reached it, so it is ordered with the events of both paths. The pairs must be
+// dispatched serially (with the informer mutex held), so the tasks are queued in the same order on both
+// workers.
+func (f *fsHandler) dispatchPair(path, otherPath string, task func()) bool {
+	f.queuesMutex.RLock()
+	defer f.queuesMutex.RUnlock()
+	first, second := f.queueIndex(path), f.queueIndex(otherPath)
+	if first == second {
+		return f.enqueue(first, task)
+	}
+	// The task always waits on the lower queue, so the workers never wait for each other in a cycle
+	if first > second {
+		first, second = second, first
+	}
+	ready, done := make(chan struct{}), make(chan struct{})
+	if !f.enqueue(first, func() {
+		defer close(done)
+		<-ready
+		task()
+	}) {
+		return false
+	}
+	if !f.enqueue(second, func() {
+		close(ready)
+		<-done
+	}) {
+		// The informer was stopped, the other worker is draining its queue
+		close(ready)
+	}
+	return true
+}
+
+// dispatchTracked dispatches the task for one path or for the pair of paths and adds it to the wait group.
+// The task is done when it ran or when it was not dispatched.
+func (f *fsHandler) dispatchTracked(wg *sync.WaitGroup, task func(), paths ...string) {
+	wg.Add(1)
+	tracked := func() {
+		defer wg.Done()
+		task()
+	}
+	var dispatched bool
+	if len(paths) > 1 {
+		dispatched = f.dispatchPair(paths[0], paths[1], tracked)
+	} else {
+		dispatched = f.dispatch(paths[0], tracked)
+	}
+	if !dispatched {
+		wg.Done()
+	}
+}
+
+func (f *fsHandler) queueIndex(path string) int {
+	return int(xxhash.Sum64String(path) % uint64(len(f.queues)))
+}
+
+// enqueue adds the task to the queue. Must be called with the queues mutex held for reading.
+func (f *fsHandler) enqueue(index int, task func()) bool {
+	if f.queuesStopped {
+		return false
+	}
+	select {
+	case f.queues[index] <- task:
+		return true
+	case <-f.stopCh:
+		return false
+	}
+}
+
+// refreshResult is the file refreshed from the disk.
+type refreshResult struct {
+	path string
+	// old is the stored version of the file, nil when the file is not stored
+	old     types.File
+	item    types.File
+	changed bool
+	err     error
+}
+
+// refreshFiles reads the paths that changed since they were stored. The files are read by the workers in
+// parallel, the results are in the order of the paths.
+func refreshFiles(store cache.Store, options types.FileOptions, workers int, paths []string) []refreshResult {
+	results := make([]refreshResult, len(paths))
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = refreshFile(store, options, paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func refreshFile(store cache.Store, options types.FileOptions, path string) refreshResult {
+	result := refreshResult{path: path}
+	obj, exists, err := store.GetByKey(path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if exists {
+		result.old = obj.(types.File)
+	}
+	result.item, result.changed, result.err = types.RefreshFile(result.old, path, options)
+	return result
+}
@@ -0,0 +1,190 @@
+package informer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+func TestDispatch(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f := &fsHandler{queues: newQueues(4, 1), stopCh: stopCh}
+	f.runWorkers(stopCh)
+
+	var mutex sync.Mutex
+	order := map[string][]int{}
+	var running, maxRunning int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		for k := 0; k < 10; k++ {
+			i, key := i, fmt.Sprintf("/etc/file-%d", k)
+			wg.Add(1)
+			f.dispatch(key, func() {
+				defer wg.Done()
+				if n := atomic.AddInt64(&running, 1); n > atomic.LoadInt64(&maxRunning) {
+					atomic.StoreInt64(&maxRunning, n)
+				}
+				defer atomic.AddInt64(&running, -1)
+				mutex.Lock()
+				defer mutex.Unlock()
+				order[key] = append(order[key], i)
+			})
+		}
+	}
+	wg.Wait()
+
+	for key, indexes := range order {
+		if len(indexes) != 100 {
+			t.Errorf("expected 100 tasks for %q, got %d", key, len(indexes))
+		}
+		for i, index := range indexes {
+			if i != index {
+				t.Errorf("expected the tasks for %q in order, got %v", key, indexes)
+				break
+			}
+		}
+	}
+	if maxRunning > 4 {
+		t.Errorf("expected at most 4 concurrent tasks, got %d", maxRunning)
+	}
+}
+
+func TestDispatchPair(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f := &fsHandler{queues: newQueues(4, 1), stopCh: stopCh}
+	f.runWorkers(stopCh)
+
+	// The pair runs after the events queued before for both paths and before the events queued after
+	var mutex sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, name)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		oldPath, newPath := fmt.Sprintf("/etc/old-%d", i), fmt.Sprintf("/etc/new-%d", i)
+		f.dispatchTracked(&wg, record("before "+oldPath), oldPath)
+		f.dispatchTracked(&wg, record("before "+newPath), newPath)
+		f.dispatchTracked(&wg, record("rename "+oldPath), oldPath, newPath)
+		f.dispatchTracked(&wg, record("after "+oldPath), oldPath)
+		f.dispatchTracked(&wg, record("after "+newPath), newPath)
+	}
+	wg.Wait()
+
+	position := map[string]int{}
+	for i, name := range order {
+		position[name] = i
+	}
+	for i := 0; i < 10; i++ {
+		oldPath, newPath := fmt.Sprintf("/etc/old-%d", i), fmt.Sprintf("/etc/new-%d", i)
+		rename := position["rename "+oldPath]
+		for _, path := range []string{oldPath, newPath} {
+			if position["before "+path] > rename || position["after "+path] < rename {
+				t.Errorf("expected the rename of %q ordered with the events of %q, got %v", oldPath, path, order)
+			}
+		}
+	}
+}
+
+func TestDispatchDrain(t *testing.T) {
+	stopCh := make(chan struct{})
+	f := &fsHandler{queues: newQueues(1, 10), stopCh: stopCh}
+	f.runWorkers(stopCh)
+
+	// The worker is blocked while the events are queued, the queued events run after the stop
+	blockCh := make(chan struct{})
+	var wg sync.WaitGroup
+	f.dispatchTracked(&wg, func() { <-blockCh }, "/etc/file")
+	var ran int64
+	for i := 0; i < 5; i++ {
+		f.dispatchTracked(&wg, func() { atomic.AddInt64(&ran, 1) }, "/etc/file")
+	}
+	close(stopCh)
+	close(blockCh)
+	wg.Wait()
+	if ran != 5 {
+		t.Errorf("expected 5 queued events to run, got %d", ran)
+	}
+
+	// Nothing is dispatched after the stop
+	for !func() bool {
+		f.queuesMutex.RLock()
+		defer f.queuesMutex.RUnlock()
+		return f.queuesStopped
+	}() {
+		runtime.Gosched()
+	}
+	f.dispatchTracked(&wg, func() { t.Errorf("unexpected event dispatched after stop") }, "/etc/file")
+	wg.Wait()
+}
+
+func TestAddFilesSkipsErrors(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	var paths []string
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(baseDir, fmt.Sprintf("file-%d", i))
+		if i == 3 {
+			// Directories can't be read as files
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		} else if i != 5 {
+			if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+				t.Fatalf("unable to write file: %v", err)
+			}
+		}
+		paths = append(paths, path)
+	}
+
+	store := cache.NewIndexer(cache.Indexers{})
+	var added []string
+	errs := addFiles(store, types.FileOptions{}, 3, func(item types.File) error {
+		added = append(added, item.Name())
+		return nil
+	}, paths...)
+	if len(errs) != 1 || errors.Cause(errs[0]) != types.ErrIsDirectory {
+		t.Errorf("expected error reading the directory, got %v", errs)
+	}
+	if len(added) != 8 {
+		t.Errorf("expected 8 files added, got %v", added)
+	}
+	for _, item := range store.List() {
+		if item.(types.File) == nil || string(item.(types.File).Content()) != item.(types.File).Name() {
+			t.Errorf("unexpected stored file %#v", item)
+		}
+	}
+
+	// The unchanged files are not stored again
+	revision := store.Revision()
+	added = nil
+	addFiles(store, types.FileOptions{}, 3, func(item types.File) error {
+		added = append(added, item.Name())
+		return nil
+	}, paths...)
+	if store.Revision() != revision {
+		t.Errorf("expected the store revision %d unchanged, got %d", revision, store.Revision())
+	}
+	if len(added) != 8 {
+		t.Errorf("expected 8 unchanged files passed to postAddFunc, got %v", added)
+	}
+}
@@ -0,0 +1,106 @@
+package informer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// defaultGroupQuietPeriod is used when the file group does not specify the quiet period.
+const defaultGroupQuietPeriod = time.Second
+
+type fileGroup struct {
+	types.FileGroup
+	handler types.FileGroupEventHandler
+
+	clock clock.Clock
+	// mutex guards the timer
+	mutex sync.Mutex
+	timer clock.Timer
+	// deliverMutex serializes the deliveries, so the handler observes the snapshots in order
+	deliverMutex sync.Mutex
+	// last is the snapshot of group members delivered to the handler, guarded by the deliverMutex
+	last map[string]types.File
+}
+
+func newFileGroup(group types.FileGroup, handler types.FileGroupEventHandler, c clock.Clock) *fileGroup {
+	if group.QuietPeriod == 0 {
+		group.QuietPeriod = defaultGroupQuietPeriod
+	}
+	return &fileGroup{
+		FileGroup: group,
+		handler:   handler,
+		clock:     c,
+		last:      map[string]types.File{},
+	}
+}
+
+func (g *fileGroup) hasMember(path string) bool {
+	for _, p := range g.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule (re)starts the quiet period timer. Every change to a group member resets the timer, so the
+// deliverFunc is only called after all members stay unchanged for the quiet period.
+func (g *fileGroup) schedule(deliverFunc func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.timer = g.clock.AfterFunc(g.QuietPeriod, deliverFunc)
+}
+
+func (g *fileGroup) stop() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+// deliver snapshot the group members from the store and call the handler when the snapshot differs from
+// the last delivered snapshot. The handler is called without the group mutex held, so it might schedule
+// the delivery or stop the group.
+func (g *fileGroup) deliver(store cache.Store) {
+	g.deliverMutex.Lock()
+	defer g.deliverMutex.Unlock()
+
+	current := map[string]types.File{}
+	for _, path := range g.Paths {
+		obj, exists, err := store.GetByKey(path)
+		if err != nil || !exists {
+			continue
+		}
+		current[path] = obj.(types.File)
+	}
+	if g.ConsistentFunc != nil && !g.ConsistentFunc(current) {
+		return
+	}
+	if !groupSnapshotChanged(g.last, current) {
+		return
+	}
+	old := g.last
+	g.last = current
+	g.handler.OnGroupUpdate(g.Name, old, current)
+}
+
+func groupSnapshotChanged(old, current map[string]types.File) bool {
+	if len(old) != len(current) {
+		return true
+	}
+	for path, f := range current {
+		oldFile, ok := old[path]
+		if !ok || types.Changed(oldFile, f) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package informer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+func TestFileGroupDeliverUnlocked(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	store := cache.NewStore()
+	if err := AddFiles(store, nil, fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fakeClock := clock.NewFake(time.Now())
+	var g *fileGroup
+	delivered := make(chan map[string]types.File, 1)
+	g = newFileGroup(types.FileGroup{Name: "foo", Paths: []string{fooFilePath}}, types.FileGroupEventHandlerFuncs{
+		UpdateFunc: func(group string, oldFiles, newFiles map[string]types.File) {
+			// The handler might schedule the delivery or stop the group
+			g.schedule(func() {})
+			g.stop()
+			delivered <- newFiles
+		},
+	}, fakeClock)
+
+	go g.deliver(store)
+	select {
+	case files := <-delivered:
+		if len(files) != 1 || files[fooFilePath] == nil {
+			t.Errorf("unexpected group content: %#v", files)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for group update, the handler is blocked")
+	}
+}
@@ -1,16 +1,203 @@
 package informer
 
 import (
+	"log"
+	"os"
+	"strconv"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
 	"github.com/mfojtik/fsinformer/pkg/types"
+	"github.com/mfojtik/fsinformer/pkg/watch"
 )
 
-func NewFileInformer(resyncPeriod time.Duration, paths ...string) (types.FileInformer, error) {
-	store := cache.NewStore()
-	if err := AddFiles(store, nil, paths...); err != nil {
+// Config holds the configuration for the file informer.
+type Config struct {
+	// ResyncPeriod is the time between the relist of the paths. Zero disables the periodic relist.
+	ResyncPeriod time.Duration
+	Paths        []string
+	// ListPaths returns more paths to watch. It is called when the informer is created and on every relist,
+	// so the new paths it returns are watched (eg. the files that appear in the directory). The paths it no
+	// longer returns stay watched.
+	ListPaths func() []string
+
+	// ResyncJitter adds the random delay of up to the fraction of the period to every resync (eg. 0.1 for up to
+	// 10%). With jitter, the first resync is delayed randomly within the period, so the informers started
+	// together do not resync together.
+	ResyncJitter float64
+	// MaxResyncPeriod enables the adaptive resync: the period doubles after every full resync that found no
+	// changes, up to MaxResyncPeriod, and returns to ResyncPeriod after a change, a watch error or an event
+	// queue overflow.
+	MaxResyncPeriod time.Duration
+	// ResyncBuckets spreads the resync over the period. The paths are split into the buckets by their hash and
+	// the buckets are relisted one by one, ResyncPeriod/ResyncBuckets apart. Defaults to 1 (all paths at once).
+	ResyncBuckets int
+
+	// FileOptions controls how the content of the observed files is read and kept.
+	FileOptions types.FileOptions
+
+	// FS is the filesystem the files are read from (eg. in-memory filesystem or overlay of the configuration
+	// directory over the embedded defaults). Defaults to the OS filesystem. When set, it overrides the
+	// FileOptions filesystem.
+	FS filesystem.FS
+
+	// Indexers are the secondary indexes maintained in the informer store. The cache.InodeIndex is always
+	// maintained, it is used to pair the renamed files.
+	Indexers cache.Indexers
+
+	// AttachDiff makes the informer compute the content diff on update and pass it to the OnUpdate
+	// handlers as diff.FileWithDiff (see diff.FromObject).
+	AttachDiff bool
+
+	// SnapshotPath is the file where the informer checkpoints the store after the relists that found changes,
+	// shortly after the changes observed by the watcher and when stopped.
+	// When the snapshot exists on start, the informer reports only the files that changed since the snapshot
+	// instead of adding all files. The snapshot that can't be read is reported to the ErrorHandler and all files
+	// are added.
+	SnapshotPath string
+
+	// NewBackend returns the backend watching the filesystem. By default, fsnotify is used and the paths that
+	// can't be watched by fsnotify (eg. on NFS or when the inotify watches are exhausted) are polled. The
+	// filesystems other than OS are watched by their own backend (see filesystem.WatchableFS) or polled.
+	NewBackend func() (watch.Backend, error)
+	// PollInterval is the interval of the default polling backend. Defaults to watch.DefaultPollInterval.
+	PollInterval time.Duration
+
+	// Clock drives the resync, the group quiet periods, the polling and the age of the store history. Defaults
+	// to the real clock, the tests use clock.Fake to step through the periods.
+	Clock clock.Clock
+
+	// ErrorHandler is called with the errors of the watch backend, including watch.ErrEventOverflow when the
+	// events were lost. The informer relists the paths immediately after the error. It is also called with the
+	// errors of the files that can't be read (eg. larger than FileOptions.MaxContentSize), the files are
+	// skipped until they can be read. Defaults to logging.
+	ErrorHandler func(err error)
+
+	// Workers is the number of goroutines reading the files in the relist and dispatching the events to the
+	// handlers. The events for the same path are dispatched in order. Defaults to the number of CPUs.
+	Workers int
+	// QueueSize is the number of pending events per worker. The watch blocks when the queue is full.
+	// Defaults to 100.
+	QueueSize int
+
+	// StoreOptions configures the informer store (eg. the retained file history). The Indexers, when set,
+	// override the StoreOptions indexers.
+	StoreOptions cache.Options
+}
+
+// FileInformer is the file informer that provides access to its store.
+type FileInformer interface {
+	types.FileInformer
+
+	GetStore() cache.Store
+	GetIndexer() cache.Indexer
+	// Metrics returns the informer counters.
+	Metrics() Metrics
+	// Resync relists the paths immediately and returns after the handlers of the observed changes ran. It
+	// must be called after Run and not from the handlers.
+	Resync()
+}
+
+func NewFileInformer(resyncPeriod time.Duration, paths ...string) (FileInformer, error) {
+	return NewFileInformerWithConfig(Config{ResyncPeriod: resyncPeriod, Paths: paths})
+}
+
+func NewFileInformerWithConfig(config Config) (FileInformer, error) {
+	if config.FS != nil {
+		config.FileOptions.FS = config.FS
+	}
+	if _, err := types.NewHash(config.FileOptions.HashAlgorithm); err != nil {
 		return nil, err
 	}
-	return &fsHandler{paths: paths, store: store, resyncPeriod: resyncPeriod}, nil
+	storeOptions := config.StoreOptions
+	if storeOptions.History.Clock == nil {
+		storeOptions.History.Clock = config.Clock
+	}
+	if config.Indexers != nil {
+		storeOptions.Indexers = config.Indexers
+	}
+	// The renamed files are paired by the inode
+	indexers := cache.Indexers{cache.InodeIndex: cache.InodeIndexFunc}
+	for name, indexFunc := range storeOptions.Indexers {
+		if name != cache.InodeIndex {
+			indexers[name] = indexFunc
+		}
+	}
+	storeOptions.Indexers = indexers
+	store := cache.NewIndexerWithOptions(storeOptions)
+	var (
+		snapshot    *cache.Snapshot
+		snapshotErr error
+	)
+	if len(config.SnapshotPath) > 0 {
+		snapshot, snapshotErr = cache.LoadSnapshot(config.SnapshotPath)
+		if os.IsNotExist(snapshotErr) {
+			snapshotErr = nil
+		}
+		// Continue the store revisions from the previous run
+		if snapshot != nil && snapshot.Revision > 0 {
+			if err := store.Replace(nil, strconv.FormatUint(snapshot.Revision, 10)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.Workers < 1 {
+		config.Workers = defaultWorkers()
+	}
+	newBackend := config.NewBackend
+	if newBackend == nil {
+		newBackend = func() (watch.Backend, error) {
+			return defaultBackend(config.FileOptions.FS, config.PollInterval, clock.Default(config.Clock))
+		}
+	}
+	handler := &fsHandler{
+		paths:        append([]string(nil), config.Paths...),
+		listPaths:    config.ListPaths,
+		store:        store,
+		resync:       newResyncSchedule(config),
+		clock:        clock.Default(config.Clock),
+		fileOptions:  config.FileOptions,
+		attachDiff:   config.AttachDiff,
+		snapshotPath: config.SnapshotPath,
+		snapshot:     snapshot,
+		newBackend:   newBackend,
+		errorHandler: config.ErrorHandler,
+		relistCh:     make(chan struct{}, 1),
+		workers:      config.Workers,
+		queues:       newQueues(config.Workers, config.QueueSize),
+	}
+	if snapshotErr != nil {
+		// The corrupted snapshot is replaced by the next checkpoint
+		handler.reportError(snapshotErr)
+	}
+	handler.addListedPaths()
+	// The files that can't be read are skipped and reported by the initial relist, only the watched paths that
+	// are directories are rejected
+	for _, err := range addFiles(store, config.FileOptions, config.Workers, nil, handler.paths...) {
+		if errors.Cause(err) == types.ErrIsDirectory {
+			return nil, types.ErrIsDirectory
+		}
+	}
+	return handler, nil
+}
+
+// defaultBackend returns the fsnotify backend falling back to polling. When fsnotify is not available at all,
+// all paths are polled.
+func defaultBackend(fsys filesystem.FS, pollInterval time.Duration, c clock.Clock) (watch.Backend, error) {
+	if w, ok := fsys.(filesystem.WatchableFS); ok {
+		return w.NewBackend()
+	}
+	if !filesystem.IsOS(fsys) {
+		return watch.NewPollerFS(pollInterval, fsys, c), nil
+	}
+	fsnotifyBackend, err := watch.NewFSNotify()
+	if err != nil {
+		log.Printf("unable to create fsnotify watcher, falling back to polling: %v", err)
+		return watch.NewPollerFS(pollInterval, nil, c), nil
+	}
+	return watch.WithFallback(fsnotifyBackend, watch.NewPollerFS(pollInterval, nil, c)), nil
 }
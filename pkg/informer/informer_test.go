@@ -1,13 +1,25 @@
 package informer
 
 import (
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/diff"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
 	"github.com/mfojtik/fsinformer/pkg/types"
+	"github.com/mfojtik/fsinformer/pkg/watch"
 )
 
 func TestInformerIsDirectory(t *testing.T) {
@@ -33,15 +45,18 @@ func TestInformerBasic(t *testing.T) {
 	}
 
 	var (
-		isTestFooObserved = make(chan struct{})
-		isTestFooDeleted  = make(chan struct{})
-		isTestFooUpdated  = make(chan struct{})
+		isTestFooObserved     = make(chan struct{})
+		isTestFooObservedOnce sync.Once
+		isTestFooDeleted      = make(chan struct{})
+		isTestFooDeletedOnce  sync.Once
+		isTestFooUpdated      = make(chan struct{})
+		isTestFooUpdatedOnce  sync.Once
 	)
 
 	informer.AddEventHandler(types.FileEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			f := obj.(types.File)
-			defer close(isTestFooObserved)
+			defer isTestFooObservedOnce.Do(func() { close(isTestFooObserved) })
 			if f.Name() != fooFilePath {
 				t.Errorf("expected 'test_foo', got: %v", f.Name())
 			}
@@ -51,11 +66,14 @@ func TestInformerBasic(t *testing.T) {
 			if string(f.Content()) != "foo" {
 				t.Errorf("expected 'test_foo' with 'foo' content, got %q", string(f.Content()))
 			}
+			if f.Revision() == 0 {
+				t.Errorf("expected the stored 'test_foo' with revision")
+			}
 		},
 		UpdateFunc: func(old, obj interface{}) {
 			f := obj.(types.File)
 			oldFile := old.(types.File)
-			defer close(isTestFooUpdated)
+			defer isTestFooUpdatedOnce.Do(func() { close(isTestFooUpdated) })
 			if f.Name() != fooFilePath {
 				t.Errorf("expected 'test_foo', got: %v", f.Name())
 			}
@@ -68,10 +86,13 @@ func TestInformerBasic(t *testing.T) {
 			if string(oldFile.Content()) != "foo" {
 				t.Errorf("expected old file to be 'foo', got: %q", string(oldFile.Content()))
 			}
+			if f.Revision() <= oldFile.Revision() {
+				t.Errorf("expected the revision %d newer than the old revision %d", f.Revision(), oldFile.Revision())
+			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			f := obj.(types.File)
-			defer close(isTestFooDeleted)
+			defer isTestFooDeletedOnce.Do(func() { close(isTestFooDeleted) })
 			if f.Name() != fooFilePath {
 				t.Errorf("expected 'test_foo', got: %v", f.Name())
 			}
@@ -124,3 +145,1624 @@ func TestInformerBasic(t *testing.T) {
 		t.Fatalf("timeout while waiting for test foo to be deleted")
 	}
 }
+
+func TestInformerGroup(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	certFilePath := filepath.Join(baseDir, "tls.crt")
+	keyFilePath := filepath.Join(baseDir, "tls.key")
+
+	fakeClock := newSchedulingClock()
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updates := make(chan map[string]types.File, 10)
+	informer.AddGroupEventHandler(types.FileGroup{
+		Name:        "serving-cert",
+		Paths:       []string{certFilePath, keyFilePath},
+		QuietPeriod: 500 * time.Millisecond,
+		ConsistentFunc: func(files map[string]types.File) bool {
+			return len(files) == 2
+		},
+	}, types.FileGroupEventHandlerFuncs{
+		UpdateFunc: func(group string, oldFiles, newFiles map[string]types.File) {
+			if group != "serving-cert" {
+				t.Errorf("expected 'serving-cert' group, got %q", group)
+			}
+			updates <- newFiles
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	fakeClock.waitScheduled(t, time.Minute)
+	expectNoUpdate := func() {
+		t.Helper()
+		select {
+		case files := <-updates:
+			t.Errorf("unexpected group update: %#v", files)
+		default:
+		}
+	}
+
+	// Write the key first and let the cert follow shortly after; only one update must be delivered.
+	if err := ioutil.WriteFile(keyFilePath, []byte("key"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.events <- watch.Event{Name: keyFilePath, Op: watch.Create}
+	fakeClock.waitScheduled(t, 500*time.Millisecond)
+	fakeClock.Advance(400 * time.Millisecond)
+	expectNoUpdate()
+	if err := ioutil.WriteFile(certFilePath, []byte("cert"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.events <- watch.Event{Name: certFilePath, Op: watch.Create}
+	fakeClock.waitScheduled(t, 500*time.Millisecond)
+
+	// The cert change restarted the quiet period, the group is delivered once the members settle
+	fakeClock.Advance(400 * time.Millisecond)
+	expectNoUpdate()
+	fakeClock.Advance(100 * time.Millisecond)
+	select {
+	case files := <-updates:
+		if string(files[certFilePath].Content()) != "cert" || string(files[keyFilePath].Content()) != "key" {
+			t.Errorf("unexpected group content: %#v", files)
+		}
+	default:
+		t.Fatalf("expected the group update after the quiet period")
+	}
+	fakeClock.Advance(time.Second)
+	expectNoUpdate()
+}
+
+func TestInformerMetadataUpdate(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	informer, err := NewFileInformer(4*time.Second, fooFilePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	isTestFooObserved := make(chan struct{}, 10)
+	isTestFooChmoded := make(chan struct{})
+	var isTestFooChmodedOnce sync.Once
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isTestFooObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			t.Errorf("unexpected content update")
+		},
+		MetadataUpdateFunc: func(old, obj interface{}) {
+			defer isTestFooChmodedOnce.Do(func() { close(isTestFooChmoded) })
+			if mode := old.(types.File).Metadata().Mode; mode != 0644 {
+				t.Errorf("expected old mode 0644, got %v", mode)
+			}
+			if mode := obj.(types.File).Metadata().Mode; mode != 0600 {
+				t.Errorf("expected new mode 0600, got %v", mode)
+			}
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+
+	select {
+	case <-isTestFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo observed")
+	}
+
+	if err := os.Chmod(fooFilePath, 0600); err != nil {
+		t.Fatalf("unable to chmod file: %v", err)
+	}
+
+	select {
+	case <-isTestFooChmoded:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo metadata update")
+	}
+}
+
+func TestInformerSymlinkRetarget(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	v1FilePath := filepath.Join(baseDir, "config.v1")
+	v2FilePath := filepath.Join(baseDir, "config.v2")
+	linkPath := filepath.Join(baseDir, "config")
+	if err := ioutil.WriteFile(v1FilePath, []byte("v1"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := ioutil.WriteFile(v2FilePath, []byte("v2"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := os.Symlink(v1FilePath, linkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	informer, err := NewFileInformer(4*time.Second, linkPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	isLinkObserved := make(chan struct{}, 10)
+	isLinkUpdated := make(chan struct{})
+	var isLinkUpdatedOnce sync.Once
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isLinkObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			defer isLinkUpdatedOnce.Do(func() { close(isLinkUpdated) })
+			if target := old.(types.File).Metadata().ResolvedTarget; target != v1FilePath {
+				t.Errorf("expected old target %q, got %q", v1FilePath, target)
+			}
+			if target := obj.(types.File).Metadata().ResolvedTarget; target != v2FilePath {
+				t.Errorf("expected new target %q, got %q", v2FilePath, target)
+			}
+			if content := string(obj.(types.File).Content()); content != "v2" {
+				t.Errorf("expected 'v2' content, got %q", content)
+			}
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+
+	select {
+	case <-isLinkObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for link observed")
+	}
+
+	retargetSymlink(t, v2FilePath, linkPath)
+
+	select {
+	case <-isLinkUpdated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for link update")
+	}
+}
+
+// retargetSymlink atomically replaces the symlink (ln -sfn).
+func retargetSymlink(t *testing.T, target, linkPath string) {
+	if err := os.Symlink(target, linkPath+".tmp"); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := os.Rename(linkPath+".tmp", linkPath); err != nil {
+		t.Fatalf("unable to rename symlink: %v", err)
+	}
+}
+
+func TestInformerSymlinkChain(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	// config -> links/current -> data/v1, every hop in other directory
+	for _, dir := range []string{"config", "links", "data"} {
+		if err := os.Mkdir(filepath.Join(baseDir, dir), 0755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+	}
+	v1FilePath := filepath.Join(baseDir, "data", "v1")
+	v2FilePath := filepath.Join(baseDir, "data", "v2")
+	currentLinkPath := filepath.Join(baseDir, "links", "current")
+	linkPath := filepath.Join(baseDir, "config", "config")
+	if err := ioutil.WriteFile(v1FilePath, []byte("v1"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := ioutil.WriteFile(v2FilePath, []byte("v2"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := os.Symlink(v1FilePath, currentLinkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := os.Symlink(currentLinkPath, linkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{linkPath},
+		FileOptions:  types.FileOptions{SymlinkPolicy: types.SymlinkChain},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	added := make(chan struct{}, 1)
+	updated := make(chan string, 10)
+	deleted := make(chan struct{}, 1)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			updated <- string(obj.(types.File).Content())
+		},
+		DeleteFunc: func(obj interface{}) {
+			deleted <- struct{}{}
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	select {
+	case <-added:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for link observed")
+	}
+	expectUpdate := func(want string) {
+		select {
+		case content := <-updated:
+			if content != want {
+				t.Errorf("expected %q content, got %q", want, content)
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for %q update", want)
+		}
+	}
+	hops := func() map[string]string {
+		f := informer.(*fsHandler)
+		f.linksMutex.Lock()
+		defer f.linksMutex.Unlock()
+		result := map[string]string{}
+		for hop, path := range f.linkHops {
+			result[hop] = path
+		}
+		return result
+	}
+
+	// Retarget the link in the middle of the chain
+	retargetSymlink(t, v2FilePath, currentLinkPath)
+	expectUpdate("v2")
+	if got := hops(); len(got) != 2 || got[currentLinkPath] != linkPath || got[v2FilePath] != linkPath {
+		t.Errorf("expected hops of the new chain only, got %v", got)
+	}
+
+	// The new target in other directory is watched
+	if err := ioutil.WriteFile(v2FilePath, []byte("v2 updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	expectUpdate("v2 updated")
+
+	if err := os.Remove(linkPath); err != nil {
+		t.Fatalf("unable to remove symlink: %v", err)
+	}
+	select {
+	case <-deleted:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for delete")
+	}
+	if got := hops(); len(got) != 0 {
+		t.Errorf("expected no hops after the link was removed, got %v", got)
+	}
+}
+
+func TestInformerSymlinkNoFollow(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	for _, dir := range []string{"config", "data"} {
+		if err := os.Mkdir(filepath.Join(baseDir, dir), 0755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+	}
+	v1FilePath := filepath.Join(baseDir, "data", "v1")
+	v2FilePath := filepath.Join(baseDir, "data", "v2")
+	linkPath := filepath.Join(baseDir, "config", "config")
+	for _, path := range []string{v1FilePath, v2FilePath} {
+		if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	if err := os.Symlink(v1FilePath, linkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{linkPath},
+		FileOptions:  types.FileOptions{SymlinkPolicy: types.SymlinkNoFollow},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	added := make(chan string, 1)
+	updated := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			added <- string(obj.(types.File).Content())
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			updated <- string(obj.(types.File).Content())
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	select {
+	case content := <-added:
+		if content != v1FilePath {
+			t.Errorf("expected the link target as content, got %q", content)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for link observed")
+	}
+
+	// The change of the target is not the change of the link
+	if err := ioutil.WriteFile(v1FilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	retargetSymlink(t, v2FilePath, linkPath)
+	select {
+	case content := <-updated:
+		if content != v2FilePath {
+			t.Errorf("expected the new link target as content, got %q", content)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for link update")
+	}
+	select {
+	case content := <-updated:
+		t.Errorf("unexpected update %q", content)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInformerSkipsUnreadableFiles(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	largeFilePath := filepath.Join(baseDir, "test_large")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := ioutil.WriteFile(largeFilePath, []byte("too large content"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	var (
+		mutex    sync.Mutex
+		reported []error
+		added    []string
+	)
+	informer, err := NewFileInformerWithConfig(Config{
+		Paths:       []string{fooFilePath, largeFilePath},
+		FileOptions: types.FileOptions{MaxContentSize: 10},
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+		ErrorHandler: func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			reported = append(reported, err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			added = append(added, obj.(types.File).Name())
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	informer.Resync()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(added) != 1 || added[0] != fooFilePath {
+		t.Errorf("expected only %q added, got %v", fooFilePath, added)
+	}
+	if len(reported) == 0 || errors.Cause(reported[0]) != types.ErrTooLarge {
+		t.Errorf("expected the large file reported, got %v", reported)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+
+	store := cache.NewIndexerWithOptions(cache.Options{History: cache.HistoryOptions{MaxVersions: 5}})
+	for _, content := range []string{"foo", "updated foo"} {
+		if err := ioutil.WriteFile(fooFilePath, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		if err := AddFiles(store, nil, fooFilePath); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := Rollback(store, fooFilePath, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(fooFilePath); string(content) != "foo" {
+		t.Errorf("expected 'foo' content after rollback, got %q", string(content))
+	}
+}
+
+func TestRollbackSymlink(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	dataFilePath := filepath.Join(baseDir, "..data")
+	linkPath := filepath.Join(baseDir, "config")
+	if err := os.Symlink(dataFilePath, linkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	for _, policy := range []types.SymlinkPolicy{types.SymlinkFollow, types.SymlinkChain, types.SymlinkNoFollow} {
+		store := cache.NewIndexerWithOptions(cache.Options{History: cache.HistoryOptions{MaxVersions: 5}})
+		options := types.FileOptions{SymlinkPolicy: policy}
+		for _, content := range []string{"foo", "updated foo"} {
+			if err := ioutil.WriteFile(dataFilePath, []byte(content), 0600); err != nil {
+				t.Fatalf("unable to write file: %v", err)
+			}
+			if err := AddFilesWithOptions(store, options, nil, linkPath); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		err := Rollback(store, linkPath, 1)
+		if policy == types.SymlinkNoFollow {
+			if err == nil {
+				t.Errorf("expected error rolling back the symlink stored as link")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The target is rewritten, the symlink is kept
+		if lstat, err := os.Lstat(linkPath); err != nil || lstat.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %q to stay symlink: %v", linkPath, err)
+		}
+		stat, err := os.Stat(dataFilePath)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stat.Mode().Perm() != 0600 {
+			t.Errorf("expected the target mode kept, got %v", stat.Mode())
+		}
+		if content, _ := ioutil.ReadFile(linkPath); string(content) != "foo" {
+			t.Errorf("expected 'foo' content after rollback, got %q", string(content))
+		}
+	}
+}
+
+func TestInformerSnapshot(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	barFilePath := filepath.Join(baseDir, "test_bar")
+	bazFilePath := filepath.Join(baseDir, "test_baz")
+	quxFilePath := filepath.Join(baseDir, "test_qux")
+	snapshotPath := filepath.Join(baseDir, "snapshot.json")
+	for _, path := range []string{fooFilePath, barFilePath, quxFilePath} {
+		if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+
+	store := cache.NewStore()
+	if err := AddFiles(store, nil, fooFilePath, barFilePath, bazFilePath, quxFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cache.SaveSnapshot(store, snapshotPath); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	// Change the files while the informer is not running
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := os.Remove(barFilePath); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	if err := ioutil.WriteFile(bazFilePath, []byte("baz"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fakeClock := newSchedulingClock()
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath, barFilePath, bazFilePath, quxFilePath},
+		SnapshotPath: snapshotPath,
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rev := informer.GetStore().Revision(); rev <= store.Revision() {
+		t.Errorf("expected revision to continue after %d, got %d", store.Revision(), rev)
+	}
+
+	events := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events <- "add " + obj.(types.File).Name()
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			if _, err := old.(types.File).ReadContent(); err != cache.ErrContentNotAvailable {
+				t.Errorf("expected old content not available, got %v", err)
+			}
+			events <- "update " + obj.(types.File).Name()
+		},
+		DeleteFunc: func(obj interface{}) {
+			events <- "delete " + obj.(types.File).Name()
+		},
+	})
+
+	stopCh := make(chan struct{})
+	informer.Run(stopCh)
+
+	observed := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-events:
+			observed[event] = true
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for offline changes, observed: %v", observed)
+		}
+	}
+	for _, event := range []string{"update " + fooFilePath, "delete " + barFilePath, "add " + bazFilePath} {
+		if !observed[event] {
+			t.Errorf("expected %q, observed: %v", event, observed)
+		}
+	}
+	fakeClock.waitScheduled(t, time.Minute)
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+	close(stopCh)
+
+	// The initial relist saved the snapshot
+	snapshot, err := cache.LoadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if len(snapshot.Files) != 3 {
+		t.Errorf("expected 3 files in snapshot, got %#v", snapshot.Files)
+	}
+	if snapshot.HashAlgorithm != types.SHA256 {
+		t.Errorf("expected %s hash algorithm in snapshot, got %q", types.SHA256, snapshot.HashAlgorithm)
+	}
+}
+
+func TestInformerSnapshotCorrupted(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	snapshotPath := filepath.Join(baseDir, "snapshot.json")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	// The truncated snapshot
+	if err := ioutil.WriteFile(snapshotPath, []byte(`{"revision":3,"files":[{"pa`), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	errs := make(chan error, 10)
+	fakeClock := newSchedulingClock()
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath},
+		SnapshotPath: snapshotPath,
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+		ErrorHandler: func(err error) {
+			errs <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "invalid snapshot") {
+			t.Errorf("expected invalid snapshot error, got %v", err)
+		}
+	default:
+		t.Errorf("expected the corrupted snapshot reported")
+	}
+
+	isTestFooObserved := make(chan struct{}, 1)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isTestFooObserved <- struct{}{}
+		},
+	})
+	stopCh := make(chan struct{})
+	informer.Run(stopCh)
+	select {
+	case <-isTestFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for the file added")
+	}
+	defer close(stopCh)
+
+	// The initial relist replaces the corrupted snapshot
+	fakeClock.waitScheduled(t, time.Minute)
+	snapshot, err := cache.LoadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if len(snapshot.Files) != 1 {
+		t.Errorf("expected 1 file in snapshot, got %#v", snapshot.Files)
+	}
+}
+
+func TestSnapshotHashAlgorithmChanged(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	barFilePath := filepath.Join(baseDir, "test_bar")
+	snapshotPath := filepath.Join(baseDir, "snapshot.json")
+	for _, path := range []string{fooFilePath, barFilePath} {
+		if err := ioutil.WriteFile(path, []byte("foo"), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	store := cache.NewStore()
+	if err := AddFiles(store, nil, fooFilePath, barFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cache.SaveSnapshot(store, snapshotPath); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	// The digests are recomputed by the snapshot algorithm, only the file that changed is reported
+	fakeClock := newSchedulingClock()
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath, barFilePath},
+		SnapshotPath: snapshotPath,
+		FileOptions:  types.FileOptions{HashAlgorithm: types.XXHash},
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			events <- "update " + obj.(types.File).Name()
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	select {
+	case event := <-events:
+		if event != "update "+fooFilePath {
+			t.Errorf("expected update of %q, got %q", fooFilePath, event)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for the update of %q", fooFilePath)
+	}
+	fakeClock.waitScheduled(t, time.Minute)
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+}
+
+func TestInformerPolling(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath},
+		NewBackend: func() (watch.Backend, error) {
+			return watch.NewPoller(10 * time.Millisecond), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	isTestFooObserved := make(chan struct{}, 1)
+	isTestFooUpdated := make(chan struct{})
+	var isTestFooUpdatedOnce sync.Once
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isTestFooObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			defer isTestFooUpdatedOnce.Do(func() { close(isTestFooUpdated) })
+			if content := string(obj.(types.File).Content()); content != "updated" {
+				t.Errorf("expected updated content, got %q", content)
+			}
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+
+	select {
+	case <-isTestFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo observed")
+	}
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	select {
+	case <-isTestFooUpdated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo update")
+	}
+}
+
+// fakeBackend is the watch backend with events injected by the test.
+type fakeBackend struct {
+	events chan watch.Event
+	errors chan error
+}
+
+func (b *fakeBackend) Add(name string) error      { return nil }
+func (b *fakeBackend) Remove(name string) error   { return nil }
+func (b *fakeBackend) Events() <-chan watch.Event { return b.events }
+func (b *fakeBackend) Errors() <-chan error       { return b.errors }
+func (b *fakeBackend) Close() error               { return nil }
+
+// schedulingClock is the fake clock reporting the scheduled timers, so the test can wait until the informer
+// scheduled the resync or the group delivery before advancing the clock.
+type schedulingClock struct {
+	*clock.Fake
+	scheduled chan time.Duration
+}
+
+func newSchedulingClock() *schedulingClock {
+	return &schedulingClock{Fake: clock.NewFake(time.Now()), scheduled: make(chan time.Duration, 100)}
+}
+
+func (c *schedulingClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	timer := c.Fake.AfterFunc(d, f)
+	c.scheduled <- d
+	return timer
+}
+
+// waitScheduled waits for the timer with the duration, the timers with other durations are skipped. The resync
+// is scheduled after the relist handlers ran.
+func (c *schedulingClock) waitScheduled(t *testing.T, d time.Duration) {
+	t.Helper()
+	for {
+		select {
+		case scheduled := <-c.scheduled:
+			if scheduled == d {
+				return
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for the timer of %v", d)
+		}
+	}
+}
+
+// recordingBackend is the fake backend recording the watched paths. The paths must exist.
+type recordingBackend struct {
+	fakeBackend
+	mutex sync.Mutex
+	added map[string]int
+}
+
+func (b *recordingBackend) Add(name string) error {
+	if _, err := os.Stat(name); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.added[name]++
+	return nil
+}
+
+func (b *recordingBackend) addedCount(name string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.added[name]
+}
+
+func TestInformerWatchedDirRemoved(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	dir := filepath.Join(baseDir, "conf")
+	fooFilePath := filepath.Join(dir, "test_foo")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	backend := &recordingBackend{
+		fakeBackend: fakeBackend{events: make(chan watch.Event), errors: make(chan error)},
+		added:       map[string]int{},
+	}
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath},
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+		ErrorHandler: func(err error) {},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	expectAdded := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(4 * time.Second); backend.addedCount(dir) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q watched %d times, got %d", dir, want, backend.addedCount(dir))
+			}
+		}
+	}
+	expectAdded(1)
+
+	// The directory is watched again by the relist after its watch was dropped
+	backend.events <- watch.Event{Name: dir, Op: watch.Ignored}
+	backend.errors <- errors.New("watch failed (1)")
+	expectAdded(2)
+
+	// The relist also drops the watches of the directories that were removed
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("unable to remove directory: %v", err)
+	}
+	backend.errors <- errors.New("watch failed (2)")
+	for deadline := time.Now().Add(4 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, exists, _ := informer.GetStore().GetByKey(fooFilePath); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for %q deleted", fooFilePath)
+		}
+	}
+	expectAdded(2)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	backend.errors <- errors.New("watch failed (3)")
+	expectAdded(3)
+}
+
+func TestInformerOverflow(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	reportedErrors := make(chan error, 1)
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath},
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+		ErrorHandler: func(err error) {
+			reportedErrors <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	isTestFooObserved := make(chan struct{}, 1)
+	isTestFooUpdated := make(chan struct{})
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isTestFooObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			close(isTestFooUpdated)
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	select {
+	case <-isTestFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo observed")
+	}
+
+	// The write event was lost, the relist triggered by the overflow observes the change
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.events <- watch.Event{Op: watch.Overflow}
+	select {
+	case <-isTestFooUpdated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo update")
+	}
+	if err := <-reportedErrors; err != watch.ErrEventOverflow {
+		t.Errorf("expected overflow reported, got %v", err)
+	}
+	if metrics := informer.Metrics(); metrics.Overflows != 1 || metrics.TriggeredRelists != 1 || metrics.Relists != 2 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestInformerSnapshotCheckpoint(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	snapshotPath := filepath.Join(baseDir, "snapshot.json")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fakeClock := clock.NewFake(time.Now())
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod:  time.Hour,
+		ResyncBuckets: 4,
+		Paths:         []string{fooFilePath},
+		SnapshotPath:  snapshotPath,
+		Clock:         fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated := make(chan types.File, 1)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			updated <- obj.(types.File)
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	informer.Resync()
+
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.events <- watch.Event{Name: fooFilePath, Op: watch.Write}
+	var item types.File
+	select {
+	case item = <-updated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for the update")
+	}
+
+	// The change applied from the watch event is saved without waiting for the bucket relist
+	fakeClock.Advance(checkpointDelay)
+	snapshot, err := cache.LoadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if len(snapshot.Files) != 1 || snapshot.Files[0].Digest != item.Digest() {
+		t.Errorf("expected the updated file in the snapshot, got %+v", snapshot.Files)
+	}
+}
+
+func TestInformerRepeatedWatchError(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	reported := make(chan error, 20)
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath},
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+		ErrorHandler: func(err error) {
+			reported <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+
+	// The backend failing persistently (eg. the polled directory that can't be read) is relisted once
+	for i := 0; i < 10; i++ {
+		backend.errors <- errors.New("permission denied")
+	}
+	for deadline := time.Now().Add(4 * time.Second); informer.Metrics().TriggeredRelists != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for the triggered relist")
+		}
+	}
+	// Other error is reported, the errors are handled in order so the repeated errors were not reported
+	backend.errors <- errors.New("no space left on device")
+	for _, want := range []string{"permission denied", "no space left on device"} {
+		select {
+		case err := <-reported:
+			if err.Error() != want {
+				t.Errorf("expected %q reported, got %v", want, err)
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for %q reported", want)
+		}
+	}
+	if metrics := informer.Metrics(); metrics.WatchErrors != 11 || metrics.ResyncPeriod != time.Minute {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestInformerReconcile(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	barFilePath := filepath.Join(baseDir, "test_bar")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	// The backend does not report any change, only the relist observes them
+	fakeClock := newSchedulingClock()
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Paths:        []string{fooFilePath, barFilePath},
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+		ErrorHandler: func(err error) {},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events <- "add " + obj.(types.File).Name()
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			events <- "update " + obj.(types.File).Name()
+		},
+		DeleteFunc: func(obj interface{}) {
+			events <- "delete " + obj.(types.File).Name()
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	expect := func(want ...string) {
+		observed := map[string]bool{}
+		for range want {
+			select {
+			case event := <-events:
+				observed[event] = true
+			case <-time.After(4 * time.Second):
+				t.Fatalf("timeout while waiting for %v, observed: %v", want, observed)
+			}
+		}
+		for _, event := range want {
+			if !observed[event] {
+				t.Errorf("expected %q, observed: %v", event, observed)
+			}
+		}
+	}
+	expect("add " + fooFilePath)
+	fakeClock.waitScheduled(t, time.Minute)
+
+	if err := os.Remove(fooFilePath); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	if err := ioutil.WriteFile(barFilePath, []byte("bar"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.errors <- errors.New("watch failed")
+	expect("delete "+fooFilePath, "add "+barFilePath)
+	fakeClock.waitScheduled(t, time.Minute)
+
+	// Unchanged files are not reported by the relist
+	fakeClock.Advance(time.Minute)
+	fakeClock.waitScheduled(t, time.Minute)
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+}
+
+func TestInformerRename(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	for _, dir := range []string{"incoming", "processed", "archive"} {
+		if err := os.Mkdir(filepath.Join(baseDir, dir), 0755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+	}
+	incomingFilePath := filepath.Join(baseDir, "incoming", "foo")
+	processedFilePath := filepath.Join(baseDir, "processed", "foo")
+	archivedFilePath := filepath.Join(baseDir, "archive", "foo")
+	if err := ioutil.WriteFile(incomingFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	informer, err := NewFileInformer(time.Minute, incomingFilePath, processedFilePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events <- "add " + obj.(types.File).Name()
+		},
+		DeleteFunc: func(obj interface{}) {
+			events <- "delete " + obj.(types.File).Name()
+		},
+		RenameFunc: func(old, obj interface{}) {
+			events <- "rename " + old.(types.File).Name() + " " + obj.(types.File).Name()
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	expect := func(want string) {
+		select {
+		case event := <-events:
+			if event != want {
+				t.Errorf("expected %q, got %q", want, event)
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for %q", want)
+		}
+	}
+	expect("add " + incomingFilePath)
+
+	if err := os.Rename(incomingFilePath, processedFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	expect("rename " + incomingFilePath + " " + processedFilePath)
+	if _, exists, _ := informer.GetStore().GetByKey(processedFilePath); !exists {
+		t.Errorf("expected %q in store", processedFilePath)
+	}
+
+	// Moves out of the watched paths are deletes
+	if err := os.Rename(processedFilePath, archivedFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	expect("delete " + processedFilePath)
+	if keys := informer.GetStore().ListKeys(); len(keys) != 0 {
+		t.Errorf("expected empty store, got %v", keys)
+	}
+}
+
+func TestInformerResyncClock(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fakeClock := clock.NewFake(time.Now())
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Hour,
+		Paths:        []string{fooFilePath},
+		Clock:        fakeClock,
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	isTestFooObserved := make(chan struct{}, 1)
+	isTestFooUpdated := make(chan struct{})
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			isTestFooObserved <- struct{}{}
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			close(isTestFooUpdated)
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	select {
+	case <-isTestFooObserved:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo observed")
+	}
+	// Wait for the resync ticker
+	for deadline := time.Now().Add(4 * time.Second); fakeClock.Waiters() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for the resync ticker")
+		}
+	}
+
+	// The backend reports no events, the write is observed by the resync
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	fakeClock.Advance(time.Hour)
+	select {
+	case <-isTestFooUpdated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo update")
+	}
+	if relists := informer.Metrics().Relists; relists != 2 {
+		t.Errorf("expected 2 relists, got %d", relists)
+	}
+}
+
+func TestInformerReconcileRenameAcrossBuckets(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	incomingFilePath := filepath.Join(baseDir, "incoming")
+	processedFilePath := filepath.Join(baseDir, "processed")
+	if err := ioutil.WriteFile(incomingFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	// The backend does not report any change, only the relist observes them
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Hour,
+		Paths:        []string{incomingFilePath, processedFilePath},
+		NewBackend: func() (watch.Backend, error) {
+			return &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan string, 10)
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events <- "add " + obj.(types.File).Name()
+		},
+		DeleteFunc: func(obj interface{}) {
+			events <- "delete " + obj.(types.File).Name()
+		},
+		RenameFunc: func(old, obj interface{}) {
+			events <- "rename " + old.(types.File).Name() + " " + obj.(types.File).Name()
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event != want {
+				t.Errorf("expected %q, got %q", want, event)
+			}
+		case <-time.After(4 * time.Second):
+			t.Fatalf("timeout while waiting for %q", want)
+		}
+	}
+	expect("add " + incomingFilePath)
+	onlyPath := func(path string) func(string) bool {
+		return func(p string) bool { return p == path }
+	}
+
+	// The bucket with the new path pairs it with the stored file of the other bucket
+	if err := os.Rename(incomingFilePath, processedFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	informer.(*fsHandler).relist(onlyPath(processedFilePath))
+	expect("rename " + incomingFilePath + " " + processedFilePath)
+
+	// The bucket with the old path pairs it with the file at the path of the other bucket
+	if err := os.Rename(processedFilePath, incomingFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	informer.(*fsHandler).relist(onlyPath(processedFilePath))
+	expect("rename " + processedFilePath + " " + incomingFilePath)
+	// The relist returns after the handlers ran
+	informer.(*fsHandler).relist(nil)
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+}
+
+func TestInformerContentCache(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	contentCache := types.NewContentCache(1024)
+	fakeClock := newSchedulingClock()
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	informer, err := NewFileInformerWithConfig(Config{
+		ResyncPeriod: time.Minute,
+		Clock:        fakeClock,
+		Paths:        []string{fooFilePath},
+		FileOptions:  types.FileOptions{ContentCache: contentCache},
+		AttachDiff:   true,
+		StoreOptions: cache.Options{History: cache.HistoryOptions{MaxVersions: 2}},
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	isTestFooUpdated := make(chan struct{})
+	var isTestFooUpdatedOnce sync.Once
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			defer isTestFooUpdatedOnce.Do(func() { close(isTestFooUpdated) })
+			// The content of the replaced version is still retained by the store
+			if content, err := old.(types.File).ReadContent(); err != nil || string(content) != "foo\n" {
+				t.Errorf("expected old content 'foo', got %q (%v)", content, err)
+			}
+			if d, ok := diff.FromObject(obj); !ok || !strings.Contains(d.Unified, "+updated foo") {
+				t.Errorf("expected the diff attached, got %#v", obj)
+			}
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	// The initial relist must not observe the write, the update is delivered once from the event
+	fakeClock.waitScheduled(t, time.Minute)
+
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated foo\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	backend.events <- watch.Event{Name: fooFilePath, Op: watch.Write}
+	select {
+	case <-isTestFooUpdated:
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for test foo update")
+	}
+	if err := RollbackFS(nil, informer.GetStore(), fooFilePath, 1); err != nil {
+		t.Errorf("unable to roll back: %v", err)
+	}
+	// Only the stored versions are cached
+	if stats := contentCache.Stats(); stats.Files != 2 {
+		t.Errorf("expected two versions cached, got %+v", stats)
+	}
+}
+
+// countingFS is the OS filesystem counting the opened files.
+type countingFS struct {
+	filesystem.FS
+	opens int64
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	atomic.AddInt64(&c.opens, 1)
+	return c.FS.Open(name)
+}
+
+func TestInformerStatShortCircuit(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "test_foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fsys := &countingFS{FS: filesystem.OS()}
+	backend := &fakeBackend{events: make(chan watch.Event), errors: make(chan error)}
+	informer, err := NewFileInformerWithConfig(Config{
+		Paths: []string{fooFilePath},
+		FS:    fsys,
+		NewBackend: func() (watch.Backend, error) {
+			return backend, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	informer.AddEventHandler(types.FileEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			t.Errorf("unexpected content update")
+		},
+		MetadataUpdateFunc: func(old, obj interface{}) {
+			t.Errorf("unexpected metadata update")
+		},
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Run(stopCh)
+	informer.Resync()
+
+	// The events for the file with the same metadata do not read it
+	opens := atomic.LoadInt64(&fsys.opens)
+	backend.events <- watch.Event{Name: fooFilePath, Op: watch.Write}
+	backend.events <- watch.Event{Name: fooFilePath, Op: watch.Chmod}
+	informer.Resync()
+	if got := atomic.LoadInt64(&fsys.opens); got != opens {
+		t.Errorf("expected the unchanged file not read, got %d reads", got-opens)
+	}
+
+	// The new stat of the touched file is stored, so it is not read again by the relists
+	modTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fooFilePath, modTime, modTime); err != nil {
+		t.Fatalf("unable to touch file: %v", err)
+	}
+	backend.events <- watch.Event{Name: fooFilePath, Op: watch.Chmod}
+	informer.Resync()
+	obj, _, _ := informer.GetStore().GetByKey(fooFilePath)
+	if got := obj.(types.File).Metadata().ModTime; !got.Equal(modTime) {
+		t.Errorf("expected the stored modification time %v, got %v", modTime, got)
+	}
+	opens = atomic.LoadInt64(&fsys.opens)
+	informer.Resync()
+	informer.Resync()
+	if got := atomic.LoadInt64(&fsys.opens); got != opens {
+		t.Errorf("expected the touched file not read by the relist, got %d reads", got-opens)
+	}
+}
+
+func TestFindMoveByInode(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	incomingFilePath := filepath.Join(baseDir, "incoming")
+	processedFilePath := filepath.Join(baseDir, "processed")
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(baseDir, fmt.Sprintf("other_%d", i))
+		if err := ioutil.WriteFile(path, []byte("other"), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	if err := ioutil.WriteFile(incomingFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fsys := &countingFS{FS: filesystem.OS()}
+	f := &fsHandler{
+		store:       cache.NewIndexer(cache.Indexers{cache.InodeIndex: cache.InodeIndexFunc}),
+		fileOptions: types.FileOptions{FS: fsys},
+		paths:       append(paths, incomingFilePath, processedFilePath),
+	}
+	if err := AddFilesWithOptions(f.store, f.fileOptions, nil, incomingFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	obj, _, _ := f.store.GetByKey(incomingFilePath)
+	old := obj.(types.File)
+	if err := os.Rename(incomingFilePath, processedFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+
+	// Only the target is read, the other candidates are compared by stat
+	atomic.StoreInt64(&fsys.opens, 0)
+	target := f.findMoveTarget(old)
+	if target == nil || target.Name() != processedFilePath {
+		t.Fatalf("expected move target %q, got %v", processedFilePath, target)
+	}
+	if opens := atomic.LoadInt64(&fsys.opens); opens != 1 {
+		t.Errorf("expected only the target read, got %d opens", opens)
+	}
+	if source := f.findMoveSource(target); source == nil || source.Name() != incomingFilePath {
+		t.Errorf("expected move source %q, got %v", incomingFilePath, source)
+	}
+}
@@ -3,27 +3,51 @@ package informer
 import (
 	"os"
 
+	"github.com/pkg/errors"
+
 	"github.com/mfojtik/fsinformer/pkg/cache"
 	"github.com/mfojtik/fsinformer/pkg/types"
 )
 
 // AddFiles add all on-disk files into store
 func AddFiles(store cache.Store, postAddFunc func(item types.File) error, paths ...string) error {
-	for _, path := range paths {
-		f, err := types.NewFile(path)
-		if os.IsNotExist(err) {
+	return AddFilesWithOptions(store, types.FileOptions{}, postAddFunc, paths...)
+}
+
+// AddFilesWithOptions add all on-disk files into store using the file options to read them. The files are
+// read in parallel. The files that can't be read or stored are skipped and the first error is returned after
+// all other files are added.
+func AddFilesWithOptions(store cache.Store, options types.FileOptions, postAddFunc func(item types.File) error, paths ...string) error {
+	if errs := addFiles(store, options, defaultWorkers(), postAddFunc, paths...); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// addFiles add the files into store and returns the errors of the files that were skipped, in the order of
+// the paths.
+func addFiles(store cache.Store, options types.FileOptions, workers int, postAddFunc func(item types.File) error, paths ...string) []error {
+	var errs []error
+	// Avoid reading and hashing files that did not change since they were stored
+	for _, result := range refreshFiles(store, options, workers, paths) {
+		if os.IsNotExist(result.err) {
+			continue
+		} else if result.err != nil {
+			errs = append(errs, errors.Wrapf(result.err, "unable to read %q", result.path))
 			continue
-		} else if err != nil {
-			return err
 		}
-		if err := store.Add(f); err != nil {
-			return err
+		// The stored file is kept when the content did not change, so its revision is not bumped
+		if result.old == nil || result.changed {
+			if err := store.Add(result.item); err != nil {
+				errs = append(errs, errors.Wrapf(err, "unable to store %q", result.path))
+				continue
+			}
 		}
 		if postAddFunc != nil {
-			if err := postAddFunc(f); err != nil {
-				return err
+			if err := postAddFunc(result.item); err != nil {
+				errs = append(errs, errors.Wrapf(err, "unable to watch %q", result.path))
 			}
 		}
 	}
-	return nil
+	return errs
 }
@@ -0,0 +1,87 @@
+package informer
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/watch"
+)
+
+// Metrics are the informer counters.
+type Metrics struct {
+	// Relists is the number of relists, including the triggered relists.
+	Relists uint64
+	// TriggeredRelists is the number of immediate relists triggered by the event queue overflow or the watch
+	// errors.
+	TriggeredRelists uint64
+	// Overflows is the number of event queue overflows.
+	Overflows uint64
+	// WatchErrors is the number of errors reported by the watch backend.
+	WatchErrors uint64
+	// ResyncPeriod is the current resync period, adapted when MaxResyncPeriod is set.
+	ResyncPeriod time.Duration
+}
+
+// metrics holds the counters updated atomically.
+type metrics struct {
+	relists          uint64
+	triggeredRelists uint64
+	overflows        uint64
+	watchErrors      uint64
+	resyncPeriod     int64
+}
+
+func (f *fsHandler) Metrics() Metrics {
+	return Metrics{
+		Relists:          atomic.LoadUint64(&f.metrics.relists),
+		TriggeredRelists: atomic.LoadUint64(&f.metrics.triggeredRelists),
+		Overflows:        atomic.LoadUint64(&f.metrics.overflows),
+		WatchErrors:      atomic.LoadUint64(&f.metrics.watchErrors),
+		ResyncPeriod:     time.Duration(atomic.LoadInt64(&f.metrics.resyncPeriod)),
+	}
+}
+
+// handleWatchError reports the error and triggers the relist, as the events might have been lost. The error
+// that repeats (eg. the polled directory that can't be read) is reported and relisted at most once per resync
+// period, the periodic resync observes the changes in between. Must be called from the watch loop.
+func (f *fsHandler) handleWatchError(err error) {
+	if err == watch.ErrEventOverflow {
+		atomic.AddUint64(&f.metrics.overflows, 1)
+	} else {
+		atomic.AddUint64(&f.metrics.watchErrors, 1)
+		if f.isRepeatedWatchError(err) {
+			return
+		}
+	}
+	if f.errorHandler != nil {
+		f.errorHandler(err)
+	} else {
+		log.Printf("watch error: %v", err)
+	}
+	select {
+	case f.relistCh <- struct{}{}:
+	default:
+		// The relist is already pending
+	}
+}
+
+// reportError passes the error to the error handler, or logs it when the handler is not set.
+func (f *fsHandler) reportError(err error) {
+	if f.errorHandler != nil {
+		f.errorHandler(err)
+		return
+	}
+	log.Printf("%v", err)
+}
+
+// isRepeatedWatchError returns true when the error is the last reported error and the resync period did not
+// pass since it was reported. Without the periodic resync, the repeated error is not reported again.
+func (f *fsHandler) isRepeatedWatchError(err error) bool {
+	now := f.clock.Now()
+	if err.Error() == f.lastWatchError && (f.resync.period <= 0 || now.Sub(f.lastWatchErrorTime) < f.resync.period) {
+		return true
+	}
+	f.lastWatchError, f.lastWatchErrorTime = err.Error(), now
+	return false
+}
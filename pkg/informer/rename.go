@@ -0,0 +1,135 @@
+package informer
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
+	"github.com/mfojtik/fsinformer/pkg/types"
+	"github.com/mfojtik/fsinformer/pkg/watch"
+)
+
+// handleMove handles the move paired by the backend. The moves out of the watched paths are deletes and the
+// moves into the watched paths are adds.
+func (f *fsHandler) handleMove(event watch.Event) {
+	f.mutex.Lock()
+	obj, exists, _ := f.store.GetByKey(event.OldName)
+	_, replaced, _ := f.store.GetByKey(event.Name)
+	if exists && !replaced && f.isWatchedPath(event.Name) {
+		item, err := types.NewFileWithOptions(event.Name, f.fileOptions)
+		if err == nil {
+			defer f.mutex.Unlock()
+			old := obj.(types.File)
+			f.dispatchPair(old.Name(), item.Name(), func() { f.handleRename(old, item) })
+			return
+		}
+	}
+	f.mutex.Unlock()
+	f.handleEvent(watch.Event{Name: event.OldName, Op: watch.Remove})
+	f.handleEvent(watch.Event{Name: event.Name, Op: watch.Create})
+}
+
+// handleRename moves the stored file to the new path and notify the handlers.
+func (f *fsHandler) handleRename(old, item types.File) {
+	stored, err := f.store.Rename(old, item)
+	if err != nil {
+		log.Printf("unable to rename %q to %q in store: %v", old.Name(), item.Name(), err)
+		return
+	}
+	item = stored.(types.File)
+	f.checkpoint()
+	f.forgetLinkHops(old.Name())
+	if err := f.watchFile(item); err != nil {
+		log.Printf("error watching %q: %v", item.Name(), err)
+	}
+	for _, h := range f.handlerFuncs {
+		if r, ok := h.(types.RenameHandler); ok {
+			r.OnRename(old, item)
+			continue
+		}
+		h.OnDelete(old)
+		h.OnAdd(item)
+	}
+	f.notifyGroups(old.Name())
+	f.notifyGroups(item.Name())
+}
+
+// findMoveSource returns the stored file that was moved to the path of the new file. The files are paired by
+// the inode and the source must no longer exist.
+func (f *fsHandler) findMoveSource(item types.File) types.File {
+	inodes, _ := cache.InodeIndexFunc(item)
+	if len(inodes) == 0 {
+		// The filesystem does not report the inode, the files are compared by os.SameFile
+		for _, obj := range f.store.List() {
+			if stored := obj.(types.File); f.isMoveSource(stored, item) {
+				return stored
+			}
+		}
+		return nil
+	}
+	candidates, err := f.store.ByIndex(cache.InodeIndex, inodes[0])
+	if err != nil {
+		log.Printf("unable to get files by inode: %v", err)
+		return nil
+	}
+	for _, obj := range candidates {
+		if stored := obj.(types.File); f.isMoveSource(stored, item) {
+			return stored
+		}
+	}
+	return nil
+}
+
+func (f *fsHandler) isMoveSource(stored, item types.File) bool {
+	if stored.Name() == item.Name() || !sameFile(stored, item) {
+		return false
+	}
+	_, err := filesystem.Default(f.fileOptions.FS).Lstat(stored.Name())
+	return os.IsNotExist(err)
+}
+
+// findMoveTarget returns the file at the watched path the stored file was moved to. The candidates are
+// compared by stat, only the target is read.
+func (f *fsHandler) findMoveTarget(old types.File) types.File {
+	for _, path := range f.paths {
+		if path == old.Name() {
+			continue
+		}
+		if _, exists, _ := f.store.GetByKey(path); exists {
+			continue
+		}
+		if same, err := types.SameInode(old, path, f.fileOptions); err != nil || !same {
+			continue
+		}
+		item, err := types.NewFileWithOptions(path, f.fileOptions)
+		if err != nil {
+			continue
+		}
+		return item
+	}
+	return nil
+}
+
+// sameFile returns true when both files are the same inode. The filesystems that do not report the inode
+// are compared by os.SameFile.
+func sameFile(a, b types.File) bool {
+	if inode := a.Metadata().Inode; inode != 0 {
+		return inode == b.Metadata().Inode && a.Metadata().Device == b.Metadata().Device
+	}
+	return os.SameFile(a.Stat(), b.Stat())
+}
+
+// watchParentDirs watches the parent directories of the paths that do not exist, to observe them being created.
+func (f *fsHandler) watchParentDirs() {
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	for _, path := range f.paths {
+		if _, exists, _ := f.store.GetByKey(path); exists {
+			continue
+		}
+		// The directory might not exist yet, the next relist retries
+		_ = f.watchDir(filepath.Dir(path))
+	}
+}
@@ -0,0 +1,145 @@
+package informer
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+)
+
+// resyncSchedule computes the delays between the resyncs. The resync is spread over the period in buckets,
+// the delays are jittered and the period adapts to how often the resync finds changes.
+type resyncSchedule struct {
+	period    time.Duration
+	maxPeriod time.Duration
+	jitter    float64
+	buckets   int
+	rand      *rand.Rand
+
+	// current is the adapted resync period, between period and maxPeriod
+	current time.Duration
+	// quietResyncs is the number of bucket resyncs without changes since the period was adapted
+	quietResyncs int
+}
+
+func newResyncSchedule(config Config) *resyncSchedule {
+	s := &resyncSchedule{
+		period:    config.ResyncPeriod,
+		maxPeriod: config.MaxResyncPeriod,
+		jitter:    config.ResyncJitter,
+		buckets:   config.ResyncBuckets,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		current:   config.ResyncPeriod,
+	}
+	if s.buckets < 1 {
+		s.buckets = 1
+	}
+	if s.maxPeriod < s.period {
+		s.maxPeriod = s.period
+	}
+	return s
+}
+
+// interval returns the time between the bucket resyncs.
+func (s *resyncSchedule) interval() time.Duration {
+	return s.current / time.Duration(s.buckets)
+}
+
+// initialDelay returns the delay of the first resync. With jitter, the first resync happens at random time
+// within the interval, so the informers started together do not resync together. Zero means no resync.
+func (s *resyncSchedule) initialDelay() time.Duration {
+	interval := s.interval()
+	if interval <= 0 || s.jitter <= 0 {
+		return interval
+	}
+	return time.Duration(s.rand.Int63n(int64(interval))) + 1
+}
+
+// next adapts the period to the result of the last bucket resync and returns the delay of the next resync.
+// The period doubles after the full resync without changes and resets to the base period on change.
+func (s *resyncSchedule) next(changed bool) time.Duration {
+	switch {
+	case changed:
+		s.reset()
+	case s.maxPeriod > s.period:
+		s.quietResyncs++
+		if s.quietResyncs >= s.buckets {
+			s.quietResyncs = 0
+			if s.current *= 2; s.current > s.maxPeriod {
+				s.current = s.maxPeriod
+			}
+		}
+	}
+	interval := s.interval()
+	if interval <= 0 || s.jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(s.rand.Float64()*s.jitter*float64(interval))
+}
+
+// reset returns to the base period (eg. after the watch error or the event queue overflow).
+func (s *resyncSchedule) reset() {
+	s.current, s.quietResyncs = s.period, 0
+}
+
+// inBucket returns the function matching the paths in the resync bucket.
+func (s *resyncSchedule) inBucket(bucket int) func(path string) bool {
+	if s.buckets == 1 {
+		return nil
+	}
+	return func(path string) bool {
+		return xxhash.Sum64String(path)%uint64(s.buckets) == uint64(bucket)
+	}
+}
+
+func (f *fsHandler) runFileSystemRelist(stopCh <-chan struct{}) {
+	// Perform the initial sweep and register all existing files into watch
+	f.relist(nil)
+
+	// Periodically re-list the on-disk files and store to synchronize the cache to match reality.
+	resyncCh := make(chan struct{}, 1)
+	var timer clock.Timer
+	scheduleResync := func(delay time.Duration) {
+		atomic.StoreInt64(&f.metrics.resyncPeriod, int64(f.resync.current))
+		if timer != nil {
+			timer.Stop()
+		}
+		if delay <= 0 {
+			return
+		}
+		timer = f.clock.AfterFunc(delay, func() {
+			select {
+			case resyncCh <- struct{}{}:
+			default:
+			}
+		})
+	}
+	scheduleResync(f.resync.initialDelay())
+	bucket := 0
+	for {
+		select {
+		case <-resyncCh:
+			changed := f.relist(f.resync.inBucket(bucket))
+			bucket = (bucket + 1) % f.resync.buckets
+			scheduleResync(f.resync.next(changed))
+		case <-f.relistCh:
+			atomic.AddUint64(&f.metrics.triggeredRelists, 1)
+			f.relist(nil)
+			// The events might have been lost, resync at the base period until the changes settle
+			scheduleResync(f.resync.next(true))
+		case <-stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			for _, g := range f.groups {
+				g.stop()
+			}
+			f.stopCheckpoint()
+			f.saveSnapshot()
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package informer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResyncSchedule(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         Config
+		changes        []bool
+		expectedDelays []time.Duration
+	}{
+		{
+			name:           "fixed period",
+			config:         Config{ResyncPeriod: time.Minute},
+			changes:        []bool{false, false, true, false},
+			expectedDelays: []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute},
+		},
+		{
+			name:           "adaptive backs off and resets on change",
+			config:         Config{ResyncPeriod: time.Minute, MaxResyncPeriod: 3 * time.Minute},
+			changes:        []bool{false, false, false, true, false},
+			expectedDelays: []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute, time.Minute, 2 * time.Minute},
+		},
+		{
+			name:           "adaptive backs off after all buckets are quiet",
+			config:         Config{ResyncPeriod: time.Minute, MaxResyncPeriod: time.Hour, ResyncBuckets: 2},
+			changes:        []bool{false, false, false, true},
+			expectedDelays: []time.Duration{30 * time.Second, time.Minute, time.Minute, 30 * time.Second},
+		},
+		{
+			name:           "disabled",
+			config:         Config{},
+			changes:        []bool{false, true},
+			expectedDelays: []time.Duration{0, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newResyncSchedule(test.config)
+			var delays []time.Duration
+			for _, changed := range test.changes {
+				delays = append(delays, s.next(changed))
+			}
+			if !reflect.DeepEqual(delays, test.expectedDelays) {
+				t.Errorf("expected delays %v, got %v", test.expectedDelays, delays)
+			}
+		})
+	}
+}
+
+func TestResyncScheduleJitter(t *testing.T) {
+	s := newResyncSchedule(Config{ResyncPeriod: time.Minute, ResyncJitter: 0.5})
+	for i := 0; i < 100; i++ {
+		if delay := s.initialDelay(); delay <= 0 || delay > time.Minute {
+			t.Fatalf("initial delay %v out of (0, 1m]", delay)
+		}
+		if delay := s.next(false); delay < time.Minute || delay > 90*time.Second {
+			t.Fatalf("delay %v out of [1m, 1m30s]", delay)
+		}
+	}
+}
+
+func TestResyncScheduleBuckets(t *testing.T) {
+	s := newResyncSchedule(Config{ResyncPeriod: time.Minute, ResyncBuckets: 4})
+	counts := map[string]int{}
+	for bucket := 0; bucket < 4; bucket++ {
+		inBucket := s.inBucket(bucket)
+		for i := 0; i < 100; i++ {
+			if path := fmt.Sprintf("/etc/file-%d", i); inBucket(path) {
+				counts[path]++
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if path := fmt.Sprintf("/etc/file-%d", i); counts[path] != 1 {
+			t.Errorf("expected %q in exactly one bucket, got %d", path, counts[path])
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package informer
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// Rollback rewrites the on-disk file with its content at the given store revision. The store must retain
+// the file history (see cache.HistoryOptions) and the content of that version (files read in
+// ContentModeMetadataOnly does not keep the content).
+func Rollback(store cache.Store, path string, revision uint64) error {
+	return RollbackFS(nil, store, path, revision)
+}
+
+// RollbackFS rewrites the file in the filesystem with its content at the given store revision. The file is
+// replaced atomically, a failed rollback leaves the current content in place. The file keeps its mode and,
+// on the filesystems with ownership, its owner. When the path was a symlink followed to the target (see
+// types.SymlinkFollow), the target the symlink resolved to at that revision is rewritten and the symlink is
+// kept. The symlinks stored as links (types.SymlinkNoFollow) are not rolled back.
+func RollbackFS(fsys filesystem.FS, store cache.Store, path string, revision uint64) error {
+	obj, exists, err := store.GetAtRevision(path, revision)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("file %q does not exist at revision %d", path, revision)
+	}
+	f := obj.(types.File)
+	content, err := f.ReadContent()
+	if err != nil {
+		return err
+	}
+	// Make sure we write the content of that version and not the current on-disk content
+	digest, err := types.ComputeDigest(f.Digest().Algorithm(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if digest != f.Digest() {
+		return fmt.Errorf("content of %q at revision %d is not retained", path, revision)
+	}
+	metadata := f.Metadata()
+	target := path
+	if len(metadata.LinkTarget) > 0 {
+		if len(metadata.ResolvedTarget) == 0 {
+			return fmt.Errorf("cannot roll back symlink %q", path)
+		}
+		target = metadata.ResolvedTarget
+	}
+	return filesystem.WriteFileAtomicWithOwner(fsys, target, content, f.Stat().Mode().Perm(), int(metadata.UID), int(metadata.GID))
+}
@@ -0,0 +1,146 @@
+package informer
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/types"
+)
+
+// handleOfflineChanges notify the handlers about the changes made while the informer was not running, by
+// comparing the store after the initial list with the snapshot saved by the previous run. Files that did not
+// change are not reported. The handlers are dispatched and added to the wait group.
+func (f *fsHandler) handleOfflineChanges(dispatched *sync.WaitGroup, snapshot *cache.Snapshot) {
+	seen := map[string]bool{}
+	for _, entry := range snapshot.Files {
+		seen[entry.Path] = true
+		old := entry.File()
+		obj, exists, err := f.store.GetByKey(entry.Path)
+		if err != nil {
+			log.Printf("unable to get %q from store: %v", entry.Path, err)
+			continue
+		}
+		path := entry.Path
+		if !exists {
+			f.dispatchTracked(dispatched, func() {
+				for _, h := range f.handlerFuncs {
+					h.OnDelete(old)
+				}
+				f.notifyGroups(path)
+			}, path)
+			continue
+		}
+		item := obj.(types.File)
+		switch {
+		case changedSince(old, item, snapshot.HashAlgorithm):
+			f.dispatchTracked(dispatched, func() {
+				for _, h := range f.handlerFuncs {
+					h.OnUpdate(old, item)
+				}
+				f.notifyGroups(path)
+			}, path)
+		case !old.Metadata().AttributesEqual(item.Metadata()):
+			f.dispatchTracked(dispatched, func() {
+				for _, h := range f.handlerFuncs {
+					if m, ok := h.(types.MetadataUpdateHandler); ok {
+						m.OnMetadataUpdate(old, item)
+					}
+				}
+			}, path)
+		}
+	}
+	for _, obj := range f.store.List() {
+		item := obj.(types.File)
+		if seen[item.Name()] {
+			continue
+		}
+		f.dispatchTracked(dispatched, func() {
+			for _, h := range f.handlerFuncs {
+				h.OnAdd(item)
+			}
+			f.notifyGroups(item.Name())
+		}, item.Name())
+	}
+}
+
+// changedSince returns true when the file changed since it was recorded in the snapshot. When the snapshot
+// digests were computed by other hash algorithm (eg. the algorithm was changed between the runs), the digest
+// of the file is recomputed by the snapshot algorithm.
+func changedSince(old, item types.File, algorithm types.HashAlgorithm) bool {
+	if len(algorithm) == 0 {
+		// The snapshots saved before the algorithm was recorded
+		algorithm = old.Digest().Algorithm()
+	}
+	if algorithm == item.Digest().Algorithm() {
+		return types.Changed(old, item)
+	}
+	if old.Metadata().ResolvedTarget != item.Metadata().ResolvedTarget {
+		return true
+	}
+	content, err := item.ReadContent()
+	if err != nil {
+		log.Printf("unable to read %q: %v", item.Name(), err)
+		return true
+	}
+	digest, err := types.ComputeDigest(algorithm, bytes.NewReader(content))
+	if err != nil {
+		log.Printf("unable to compute %s digest of %q: %v", algorithm, item.Name(), err)
+		return true
+	}
+	return old.Digest() != digest
+}
+
+// checkpointDelay is how long after the change applied from the watch events the snapshot is saved. The
+// changes made within the delay are saved by a single snapshot.
+const checkpointDelay = time.Second
+
+// checkpoint schedules saving of the snapshot after the store was changed by the watch events. The relist
+// saves the snapshot only when the relisted paths changed, the changes observed by the watcher would be
+// otherwise saved only when the informer stops.
+func (f *fsHandler) checkpoint() {
+	if len(f.snapshotPath) == 0 {
+		return
+	}
+	f.checkpointMutex.Lock()
+	defer f.checkpointMutex.Unlock()
+	if f.checkpointTimer != nil {
+		return
+	}
+	f.checkpointTimer = f.clock.AfterFunc(checkpointDelay, func() {
+		f.checkpointMutex.Lock()
+		f.checkpointTimer = nil
+		f.checkpointMutex.Unlock()
+		select {
+		case <-f.stopCh:
+			// The snapshot is saved when the informer stops
+			return
+		default:
+		}
+		f.saveSnapshot()
+	})
+}
+
+// stopCheckpoint cancels the scheduled checkpoint.
+func (f *fsHandler) stopCheckpoint() {
+	f.checkpointMutex.Lock()
+	defer f.checkpointMutex.Unlock()
+	if f.checkpointTimer != nil {
+		f.checkpointTimer.Stop()
+		f.checkpointTimer = nil
+	}
+}
+
+func (f *fsHandler) saveSnapshot() {
+	if len(f.snapshotPath) == 0 {
+		return
+	}
+	// The snapshots are saved by the relist and the checkpoints, the older snapshot must not replace the newer
+	f.snapshotMutex.Lock()
+	defer f.snapshotMutex.Unlock()
+	if err := cache.SaveSnapshot(f.store, f.snapshotPath); err != nil {
+		log.Printf("unable to save snapshot to %q: %v", f.snapshotPath, err)
+	}
+}
@@ -3,28 +3,81 @@ package informer
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
 	"github.com/mfojtik/fsinformer/pkg/cache"
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/diff"
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
 	"github.com/mfojtik/fsinformer/pkg/types"
+	"github.com/mfojtik/fsinformer/pkg/watch"
 )
 
 type fsHandler struct {
 	handlerFuncs []types.FileEventHandler
-	store        cache.Store
+	groups       []*fileGroup
+	store        cache.Indexer
 
 	// mutex is needed to avoid race between relist and watcher
 	mutex sync.Mutex
+	// relistMutex serializes the relists including their handlers
+	relistMutex sync.Mutex
+
+	// resync schedules the periodic relist of the paths
+	resync *resyncSchedule
+	clock  clock.Clock
+
+	watcher    watch.Backend
+	newBackend func() (watch.Backend, error)
+
+	errorHandler func(err error)
+	// relistCh triggers the immediate relist when the events might have been lost
+	relistCh chan struct{}
+	metrics  metrics
+	// lastWatchError is the last reported watch error, it is used by the watch loop only
+	lastWatchError     string
+	lastWatchErrorTime time.Time
+
+	// workers is the number of goroutines reading the files in the relist
+	workers int
+	// queues are the event queues of the dispatch workers
+	queues []chan func()
+	// queuesStopped is set when the workers drain the queues, guarded by the queues mutex
+	queuesStopped bool
+	queuesMutex   sync.RWMutex
 
-	// resyncPeriod is the time we should perform list of the path
-	resyncPeriod time.Duration
+	// fileOptions controls how the files are read
+	fileOptions types.FileOptions
+	attachDiff  bool
 
-	watcher *fsnotify.Watcher
+	snapshotPath string
+	// snapshot is the snapshot from the previous run, it is used for the initial relist
+	snapshot *cache.Snapshot
+	// snapshotMutex serializes saving of the snapshots
+	snapshotMutex sync.Mutex
+	// checkpointTimer is the pending save of the changes applied from the watch events
+	checkpointTimer clock.Timer
+	checkpointMutex sync.Mutex
+
+	// linkHops maps the symlinks and targets in watched symlink chains to the watched path
+	linkHops    map[string]string
+	watchedDirs map[string]bool
+	linksMutex  sync.Mutex
+
+	// listPaths returns more paths to watch, the new paths are added by the relist
+	listPaths func() []string
 
 	paths     []string
 	isStarted bool
+	stopCh    <-chan struct{}
+
+	// synced is set after the initial relist
+	synced bool
 }
 
 func (f *fsHandler) AddEventHandler(handler types.FileEventHandlerFuncs) {
@@ -34,118 +87,427 @@ func (f *fsHandler) AddEventHandler(handler types.FileEventHandlerFuncs) {
 	f.handlerFuncs = append(f.handlerFuncs, handler)
 }
 
+func (f *fsHandler) AddGroupEventHandler(group types.FileGroup, handler types.FileGroupEventHandlerFuncs) {
+	if f.isStarted {
+		panic("cannot add group handler funcs when started")
+	}
+	// Group members are watched as any other path
+	for _, path := range group.Paths {
+		if !f.isWatchedPath(path) {
+			f.paths = append(f.paths, path)
+		}
+	}
+	f.groups = append(f.groups, newFileGroup(group, handler, f.clock))
+}
+
+func (f *fsHandler) isWatchedPath(path string) bool {
+	for _, p := range f.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// addListedPaths watches the new paths returned by the listPaths. Must be called with the mutex held.
+func (f *fsHandler) addListedPaths() {
+	if f.listPaths == nil {
+		return
+	}
+	watched := make(map[string]bool, len(f.paths))
+	for _, path := range f.paths {
+		watched[path] = true
+	}
+	for _, path := range f.listPaths() {
+		if !watched[path] {
+			watched[path] = true
+			f.paths = append(f.paths, path)
+		}
+	}
+}
+
 func (f *fsHandler) Run(stopCh <-chan struct{}) {
 	var err error
-	f.watcher, err = fsnotify.NewWatcher()
+	f.watcher, err = f.newBackend()
 	if err != nil {
 		log.Fatalf("unable to create new watcher: %v", err)
 	}
+	f.stopCh = stopCh
+	f.runWorkers(stopCh)
 	go f.runFileSystemRelist(stopCh)
 	go f.runFileSystemWatch(stopCh)
 	f.isStarted = true
 }
 
+func (f *fsHandler) GetStore() cache.Store {
+	return f.store
+}
+
+func (f *fsHandler) GetIndexer() cache.Indexer {
+	return f.store
+}
+
 func (f *fsHandler) HasSynced() bool {
 	return f.isStarted
 }
 
-func (f *fsHandler) runFileSystemRelist(stopCh <-chan struct{}) {
-	// Perform the initial sweep and register all existing files into watch
-	f.relist()
-	// Periodically re-list the on-disk files and store to synchronize the cache to match reality.
-	ticker := time.NewTicker(f.resyncPeriod)
-	for {
-		select {
-		case <-ticker.C:
-			f.relist()
-		case <-stopCh:
-			ticker.Stop()
-			return
-		}
-	}
+func (f *fsHandler) Resync() {
+	f.relist(nil)
 }
 
-func (f *fsHandler) relist() {
+// relist synchronizes the store with the filesystem. When inBucket is set, only the paths in the bucket are
+// relisted. It returns true when the relist found changes or errors.
+func (f *fsHandler) relist(inBucket func(path string) bool) bool {
+	// The relist returns after the handlers ran, they are waited for without holding the lock. The next relist
+	// starts after the handlers of the previous relist ran.
+	f.relistMutex.Lock()
+	defer f.relistMutex.Unlock()
+	var dispatched sync.WaitGroup
+	defer dispatched.Wait()
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	atomic.AddUint64(&f.metrics.relists, 1)
+	f.addListedPaths()
 
-	// Refresh the store from on-disk to match the reality
-	// In case a path was specified to non-existing file, this will check if the file exists now
-	// and register it into filesystem watcher (and run OnAdd() handlers).
-	postAddFunc := func(item types.File) error {
-		if err := f.watcher.Add(item.Name()); err != nil {
-			return err
+	if f.synced {
+		changed := f.reconcile(&dispatched, inBucket)
+		// Save the store state so the next run can report the changes made while it was not running.
+		if changed || inBucket == nil {
+			f.saveSnapshot()
 		}
-		return nil
+		return changed
 	}
-	if err := AddFiles(f.store, postAddFunc, f.paths...); err != nil {
-		log.Printf("error adding file: %v", err)
+	f.synced = true
+	defer f.saveSnapshot()
+
+	// Register the files into the store and the filesystem watcher. The files were listed when the informer
+	// was created, but more paths might have been added by the groups since.
+	postAddFunc := func(item types.File) error {
+		return f.watchFile(item)
+	}
+	for _, err := range addFiles(f.store, f.fileOptions, f.workers, postAddFunc, f.paths...) {
+		f.reportError(err)
+	}
+	f.watchParentDirs()
+
+	// On the initial relist after restart, only report what changed since the last snapshot.
+	if f.snapshot != nil {
+		f.handleOfflineChanges(&dispatched, f.snapshot)
+		f.snapshot = nil
+		return true
 	}
 
-	// Relist the store periodically and execute the OnAdd() handlers for all items periodically.
-	var wg sync.WaitGroup
+	// Execute the OnAdd() handlers for all items observed by the initial list.
 	for _, item := range f.store.List() {
-		obj, err := types.NewFile(item.(types.File).Name())
-		if err != nil {
-			log.Printf("error creating file: %v", err)
+		item := item.(types.File)
+		f.dispatchTracked(&dispatched, func() {
+			for _, h := range f.handlerFuncs {
+				h.OnAdd(item)
+			}
+			f.notifyGroups(item.Name())
+		}, item.Name())
+	}
+	return true
+}
+
+// reconcile compares the on-disk files with the store and executes the handlers for the changes the watcher
+// missed. The disk is the source of truth: missing files are deleted from the store, new files are added and
+// changed files are updated. The files moved between the watched paths are renamed. When inBucket is set,
+// only the matching paths are reconciled. The handlers are dispatched and added to the wait group. It returns
+// true when any change or error was found.
+func (f *fsHandler) reconcile(dispatched *sync.WaitGroup, inBucket func(path string) bool) bool {
+	f.checkWatchedDirs()
+	var created, removed []types.File
+	changed := false
+	watched := map[string]bool{}
+	var paths []string
+	for _, path := range f.paths {
+		watched[path] = true
+		if inBucket == nil || inBucket(path) {
+			paths = append(paths, path)
+		}
+	}
+	for _, result := range refreshFiles(f.store, f.fileOptions, f.workers, paths) {
+		path, old, item := result.path, result.old, result.item
+		exists := old != nil
+		switch {
+		case os.IsNotExist(result.err):
+			if exists {
+				removed = append(removed, old)
+			}
+			continue
+		case result.err != nil:
+			f.reportError(errors.Wrapf(result.err, "unable to read %q", path))
+			changed = true
+			continue
+		}
+		// The watch is lost when the file is replaced, add it again
+		if err := f.watchFile(item); err != nil {
+			log.Printf("error watching %q: %v", path, err)
+		}
+		switch {
+		case !exists:
+			created = append(created, item)
+		case result.changed:
+			changed = true
+			f.dispatchTracked(dispatched, func() { f.handleWrite(item) }, path)
+		case !old.Metadata().Equal(item.Metadata()):
+			// The unchanged files are not dispatched
+			f.dispatchTracked(dispatched, func() { f.handleMetadataUpdate(item) }, path)
+		}
+	}
+	// Remove the stored files that are no longer watched
+	for _, key := range f.store.ListKeys() {
+		if watched[key] || (inBucket != nil && !inBucket(key)) {
+			continue
+		}
+		if obj, exists, err := f.store.GetByKey(key); err == nil && exists {
+			removed = append(removed, obj.(types.File))
 		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			f.handleCreate(obj)
-		}()
 	}
-	wg.Wait()
+	// The files are paired with all watched paths, the other end of the rename might be in other bucket
+	for _, item := range created {
+		item := item
+		var source types.File
+		for i, old := range removed {
+			if sameFile(old, item) {
+				source, removed = old, append(removed[:i], removed[i+1:]...)
+				break
+			}
+		}
+		if source == nil {
+			source = f.findMoveSource(item)
+		}
+		if source != nil {
+			f.dispatchTracked(dispatched, func() { f.handleRename(source, item) }, source.Name(), item.Name())
+		} else {
+			f.dispatchTracked(dispatched, func() { f.handleCreate(item) }, item.Name())
+		}
+	}
+	for _, old := range removed {
+		old := old
+		if target := f.findMoveTarget(old); target != nil {
+			f.dispatchTracked(dispatched, func() { f.handleRename(old, target) }, old.Name(), target.Name())
+		} else {
+			f.dispatchTracked(dispatched, func() { f.handleDelete(old) }, old.Name())
+		}
+	}
+	f.watchParentDirs()
+	return changed || len(created) > 0 || len(removed) > 0
 }
 
 func (f *fsHandler) runFileSystemWatch(stopCh <-chan struct{}) {
 	defer f.watcher.Close()
 	for {
 		select {
-		case event := <-f.watcher.Events:
-			f.mutex.Lock()
-			item, err := types.NewFile(event.Name)
-			if os.IsNotExist(err) {
-				obj, exists, err := f.store.GetByKey(event.Name)
-				if err != nil {
-					log.Printf("unable to get %q from store: %v", event.Name, err)
-					continue
-				}
-				if !exists {
-					log.Printf("file %q does not exist in store", event.Name)
-					continue
-				}
-				item = obj.(types.File)
-			} else if err != nil {
-				log.Printf("error gathering file information: %v", err)
+		case event, ok := <-f.watcher.Events():
+			if !ok {
+				return
+			}
+			if event.Op&watch.Overflow == watch.Overflow {
+				f.handleWatchError(watch.ErrEventOverflow)
 				continue
 			}
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				go f.handleCreate(item)
+			if event.Op&(watch.Remove|watch.Rename|watch.Ignored) != 0 {
+				f.forgetWatchedDir(event.Name)
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				go f.handleWrite(item)
+			if event.Op == watch.Ignored {
+				continue
 			}
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				go f.handleDelete(item)
+			if event.Op&watch.Move == watch.Move {
+				f.handleMove(event)
+				continue
 			}
-			f.mutex.Unlock()
+			f.handleEvent(event)
 		case <-stopCh:
-			break
-		case err := <-f.watcher.Errors:
-			log.Println("error:", err)
+			return
+		case err, ok := <-f.watcher.Errors():
+			if !ok {
+				return
+			}
+			f.handleWatchError(err)
+		}
+	}
+}
+
+// watchFile adds the file to the watcher. The parent directory is watched instead of the file, to observe the
+// file being created or moved to the watched path. Symlinks are watched as well, as the changes of the symlink
+// target are not visible in the watch of the directory. For symlink chains, the directories of all hops are
+// watched.
+func (f *fsHandler) watchFile(item types.File) error {
+	metadata := item.Metadata()
+	if len(metadata.LinkTarget) > 0 {
+		if err := f.watcher.Add(item.Name()); err != nil {
+			return err
+		}
+	}
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	if f.linkHops == nil {
+		f.linkHops = map[string]string{}
+	}
+	// The hops of the previous chain are no longer watched for the file (eg. the symlink was retargeted)
+	f.pruneLinkHops(item.Name())
+	dirs := []string{filepath.Dir(item.Name())}
+	if len(metadata.LinkTarget) > 0 && f.fileOptions.SymlinkPolicy == types.SymlinkChain {
+		for _, hop := range append(metadata.LinkChain[1:], metadata.ResolvedTarget) {
+			f.linkHops[hop] = item.Name()
+			dirs = append(dirs, filepath.Dir(hop))
+		}
+	}
+	for _, dir := range dirs {
+		if err := f.watchDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetLinkHops drops the symlink chain hops of the watched path that was removed or moved.
+func (f *fsHandler) forgetLinkHops(path string) {
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	f.pruneLinkHops(path)
+}
+
+// pruneLinkHops drops the symlink chain hops of the watched path. Must be called with the links mutex held.
+func (f *fsHandler) pruneLinkHops(path string) {
+	for hop, watched := range f.linkHops {
+		if watched == path {
+			delete(f.linkHops, hop)
+		}
+	}
+}
+
+// watchDir adds the directory to the watcher. Must be called with the links mutex held.
+func (f *fsHandler) watchDir(dir string) error {
+	if f.watchedDirs == nil {
+		f.watchedDirs = map[string]bool{}
+	}
+	if f.watchedDirs[dir] {
+		return nil
+	}
+	if err := f.watcher.Add(dir); err != nil {
+		return err
+	}
+	f.watchedDirs[dir] = true
+	return nil
+}
+
+// forgetWatchedDir drops the directory that is no longer watched (eg. it was removed), so it is watched again
+// when the files in it are observed.
+func (f *fsHandler) forgetWatchedDir(dir string) {
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	delete(f.watchedDirs, dir)
+}
+
+// checkWatchedDirs drops the watched directories that no longer exist. Their watches were lost, even when the
+// backend did not report it.
+func (f *fsHandler) checkWatchedDirs() {
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	for dir := range f.watchedDirs {
+		if _, err := filesystem.Default(f.fileOptions.FS).Stat(dir); err == nil {
+			continue
+		}
+		delete(f.watchedDirs, dir)
+		// The backend might still keep the watch of the removed directory
+		_ = f.watcher.Remove(dir)
+	}
+}
+
+// watchedPathFor returns the watched path the event name belongs to. Events for other files in
+// the watched symlink directories are ignored.
+func (f *fsHandler) watchedPathFor(name string) (string, bool) {
+	if f.isWatchedPath(name) {
+		return name, true
+	}
+	f.linksMutex.Lock()
+	defer f.linksMutex.Unlock()
+	path, ok := f.linkHops[name]
+	return path, ok
+}
+
+func (f *fsHandler) handleEvent(event watch.Event) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name, ok := f.watchedPathFor(event.Name)
+	if !ok {
+		return
+	}
+	if name != event.Name {
+		// A hop in the symlink chain changed, re-resolve the watched path
+		event = watch.Event{Name: name, Op: watch.Write}
+	}
+	var stored types.File
+	obj, exists, err := f.store.GetByKey(event.Name)
+	if err != nil {
+		log.Printf("unable to get %q from store: %v", event.Name, err)
+		return
+	}
+	if exists {
+		stored = obj.(types.File)
+	}
+	// The stored file is used when its metadata did not change, the file is read only when it might change
+	item, _, err := types.RefreshFile(stored, event.Name, f.fileOptions)
+	missing := os.IsNotExist(err)
+	if missing {
+		if stored == nil {
+			log.Printf("file %q does not exist in store", event.Name)
+			return
+		}
+		item = stored
+	} else if err != nil {
+		log.Printf("error gathering file information: %v", err)
+		return
+	}
+	if event.Op&watch.Create == watch.Create {
+		// File replaced by rename (eg. re-targeted symlink) is an update of the stored file
+		// File moved from other watched path is renamed
+		if _, exists, _ := f.store.Get(item); exists {
+			f.dispatch(item.Name(), func() { f.handleWrite(item) })
+		} else if source := f.findMoveSource(item); source != nil {
+			f.dispatchPair(source.Name(), item.Name(), func() { f.handleRename(source, item) })
+		} else {
+			f.dispatch(item.Name(), func() { f.handleCreate(item) })
+		}
+	}
+	if event.Op&(watch.Write|watch.CloseWrite) != 0 {
+		f.dispatch(item.Name(), func() { f.handleWrite(item) })
+	}
+	if event.Op&watch.Chmod == watch.Chmod {
+		f.dispatch(item.Name(), func() { f.handleMetadataUpdate(item) })
+	}
+	if event.Op&(watch.Remove|watch.Rename) != 0 && missing {
+		// File moved to other watched path is renamed, otherwise it was removed or moved out of the watched paths
+		if target := f.findMoveTarget(item); target != nil {
+			f.dispatchPair(item.Name(), target.Name(), func() { f.handleRename(item, target) })
+		} else {
+			f.dispatch(item.Name(), func() { f.handleDelete(item) })
 		}
+	} else if event.Op&watch.Remove == watch.Remove {
+		f.dispatch(item.Name(), func() { f.handleDelete(item) })
 	}
 }
 
 func (f *fsHandler) handleCreate(item types.File) {
-	if err := f.store.Add(item); err != nil {
+	stored, swapped, err := f.store.CompareAndSwap(nil, item)
+	if err != nil {
 		log.Printf("error adding %#+v to store: %v", item, err)
 		return
 	}
+	if !swapped {
+		// The file was stored concurrently by the relist
+		f.handleWrite(item)
+		return
+	}
+	item = stored.(types.File)
+	f.checkpoint()
 	for _, h := range f.handlerFuncs {
 		h.OnAdd(item)
 	}
+	f.notifyGroups(item.Name())
 }
 
 func (f *fsHandler) handleWrite(item types.File) {
@@ -159,24 +521,104 @@ func (f *fsHandler) handleWrite(item types.File) {
 	}
 	// No content update (in some cases, the Update() is registered when the FS first create
 	// the empty file and then writes the content to it. It might be specific to OSX...
-	if oldItem.(types.File).ContentSum256() == item.ContentSum256() {
+	// The write might still change the metadata (eg. file replaced by other user).
+	if !types.Changed(oldItem.(types.File), item) {
+		f.handleMetadataUpdate(item)
 		return
 	}
-	if err := f.store.Update(item); err != nil {
-		log.Printf("error adding %#+v to store: %v", item, err)
+	// The relist might have stored newer version of the file concurrently
+	stored, swapped, err := f.store.CompareAndSwap(oldItem, item)
+	if err != nil || !swapped {
+		log.Printf("unable to update %q in store (swapped: %v): %v", item.Name(), swapped, err)
 		return
 	}
+	item = stored.(types.File)
+	f.checkpoint()
+	if oldItem.(types.File).Metadata().ResolvedTarget != item.Metadata().ResolvedTarget {
+		// The watch of the old symlink target must be replaced
+		if err := f.watchFile(item); err != nil {
+			log.Printf("error watching %q: %v", item.Name(), err)
+		}
+	}
+	var newObj interface{} = item
+	if f.attachDiff {
+		if d, err := diff.Files(oldItem.(types.File), item); err != nil {
+			log.Printf("unable to compute diff for %q: %v", item.Name(), err)
+		} else {
+			newObj = &diff.FileWithDiff{File: item, Diff: d}
+		}
+	}
 	for _, h := range f.handlerFuncs {
-		h.OnUpdate(oldItem, item)
+		h.OnUpdate(oldItem, newObj)
+	}
+	f.notifyGroups(item.Name())
+}
+
+// handleMetadataUpdate notify handlers when the file attributes (mode, ownership, xattrs) changed.
+func (f *fsHandler) handleMetadataUpdate(item types.File) {
+	oldItem, exists, err := f.store.Get(item)
+	if err != nil {
+		log.Printf("unable to get item from store: %v", err)
+		return
+	}
+	if !exists {
+		return
+	}
+	old := oldItem.(types.File)
+	if old.Metadata().AttributesEqual(item.Metadata()) {
+		// Store the new stat (eg. after touch) without notifying, so the file is not read again on every relist
+		if !old.Metadata().Equal(item.Metadata()) && !types.Changed(old, item) {
+			if _, swapped, err := f.store.CompareAndSwap(oldItem, item); err != nil {
+				log.Printf("unable to update %q in store: %v", item.Name(), err)
+			} else if swapped {
+				f.checkpoint()
+			}
+		}
+		return
+	}
+	stored, swapped, err := f.store.CompareAndSwap(oldItem, item)
+	if err != nil || !swapped {
+		log.Printf("unable to update %q in store (swapped: %v): %v", item.Name(), swapped, err)
+		return
+	}
+	item = stored.(types.File)
+	f.checkpoint()
+	for _, h := range f.handlerFuncs {
+		if m, ok := h.(types.MetadataUpdateHandler); ok {
+			m.OnMetadataUpdate(oldItem, item)
+		}
 	}
 }
 
 func (f *fsHandler) handleDelete(item types.File) {
-	if err := f.store.Delete(item); err != nil {
-		log.Printf("error adding %#+v to store: %v", item, err)
+	deleted, err := f.store.GetAndDelete(item)
+	if err != nil {
+		log.Printf("error deleting %#+v from store: %v", item, err)
 		return
 	}
+	item = deleted.(types.File)
+	f.forgetLinkHops(item.Name())
+	f.checkpoint()
 	for _, h := range f.handlerFuncs {
 		h.OnDelete(item)
 	}
+	f.notifyGroups(item.Name())
+}
+
+// notifyGroups schedule delivery for all groups the changed file is member of.
+func (f *fsHandler) notifyGroups(path string) {
+	for _, g := range f.groups {
+		if !g.hasMember(path) {
+			continue
+		}
+		g := g
+		g.schedule(func() {
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
+			g.deliver(f.store)
+		})
+	}
 }
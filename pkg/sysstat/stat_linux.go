@@ -0,0 +1,24 @@
+package sysstat
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// FromFileInfo returns the attributes of the file. The ok is false when the file information does not come
+// from the stat syscall (eg. the in-memory filesystem).
+func FromFileInfo(info os.FileInfo) (Stat, bool) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Stat{}, false
+	}
+	return Stat{
+		ChangeTime: time.Unix(int64(sys.Ctim.Sec), int64(sys.Ctim.Nsec)),
+		Inode:      uint64(sys.Ino),
+		Device:     uint64(sys.Dev),
+		UID:        sys.Uid,
+		GID:        sys.Gid,
+		Links:      uint64(sys.Nlink),
+	}, true
+}
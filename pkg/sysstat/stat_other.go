@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package sysstat
+
+import "os"
+
+// FromFileInfo is not available on this platform, the change detection relies on the size and modification
+// time.
+func FromFileInfo(_ os.FileInfo) (Stat, bool) {
+	return Stat{}, false
+}
@@ -0,0 +1,14 @@
+// Package sysstat extracts the file attributes that os.FileInfo reports only in the platform specific Sys().
+package sysstat
+
+import "time"
+
+// Stat holds the file attributes that are not available in os.FileInfo.
+type Stat struct {
+	ChangeTime time.Time
+	Inode      uint64
+	Device     uint64
+	UID        uint32
+	GID        uint32
+	Links      uint64
+}
@@ -0,0 +1,120 @@
+package types
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ContentCache limits the memory used by the content of the files sharing it. When the budget is exceeded,
+// the content of the least recently used files is evicted, while their metadata and digest stay in memory.
+// The evicted content is reloaded from disk on the next access. Only the content of the file versions retained
+// by the store is cached: the store moves the content to the cache when it stores the version and evicts it
+// when the version leaves the store history (see ContentRetainer).
+type ContentCache struct {
+	budget int64
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[*localFile]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// ContentCacheStats are the content cache metrics.
+type ContentCacheStats struct {
+	Budget int64
+	Size   int64
+	Files  int
+
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// minEntryCost is the minimum budget used by a cached content, so the empty and tiny files are accounted for
+// the memory held by the cache entry itself.
+const minEntryCost = 64
+
+type contentEntry struct {
+	file    *localFile
+	content []byte
+}
+
+// NewContentCache returns the content cache holding at most budget bytes of content. Content larger than the
+// budget is never kept in memory.
+func NewContentCache(budget int64) *ContentCache {
+	return &ContentCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: map[*localFile]*list.Element{},
+	}
+}
+
+// Stats returns the current size of the cached content and the hit and miss counts.
+func (c *ContentCache) Stats() ContentCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return ContentCacheStats{
+		Budget:    c.budget,
+		Size:      c.size,
+		Files:     len(c.entries),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+func (c *ContentCache) get(f *localFile) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[f]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*contentEntry).content, true
+}
+
+func (c *ContentCache) put(f *localFile, content []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[f]; ok {
+		c.remove(e)
+	}
+	if entryCost(content) > c.budget {
+		return
+	}
+	c.entries[f] = c.lru.PushFront(&contentEntry{file: f, content: content})
+	c.size += entryCost(content)
+	for c.size > c.budget {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *ContentCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*contentEntry)
+	delete(c.entries, entry.file)
+	c.size -= entryCost(entry.content)
+}
+
+// evict drops the content of the file.
+func (c *ContentCache) evict(f *localFile) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[f]; ok {
+		c.remove(e)
+	}
+}
+
+func entryCost(content []byte) int64 {
+	if len(content) < minEntryCost {
+		return minEntryCost
+	}
+	return int64(len(content))
+}
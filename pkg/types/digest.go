@@ -0,0 +1,111 @@
+package types
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm is the name of the algorithm used to compute the file digest.
+type HashAlgorithm string
+
+const (
+	SHA256  HashAlgorithm = "sha256"
+	SHA512  HashAlgorithm = "sha512"
+	BLAKE2b HashAlgorithm = "blake2b"
+	// XXHash is fast non-cryptographic hash suitable for change detection only.
+	XXHash HashAlgorithm = "xxhash"
+	CRC32C HashAlgorithm = "crc32c"
+
+	// DefaultHashAlgorithm is used when the file options does not specify the algorithm.
+	DefaultHashAlgorithm = SHA256
+)
+
+var ErrUnknownHashAlgorithm = errors.New("unknown hash algorithm")
+
+var (
+	hashAlgorithmsMutex sync.RWMutex
+	hashAlgorithms      = map[HashAlgorithm]func() hash.Hash{
+		SHA256: sha256.New,
+		SHA512: sha512.New,
+		BLAKE2b: func() hash.Hash {
+			// New512 only fails when the key is too long
+			h, _ := blake2b.New512(nil)
+			return h
+		},
+		XXHash: func() hash.Hash { return xxhash.New() },
+		CRC32C: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	}
+)
+
+// RegisterHashAlgorithm makes the hash algorithm available for the file digest. Registering an algorithm
+// with an existing name replaces it.
+func RegisterHashAlgorithm(name HashAlgorithm, newFunc func() hash.Hash) {
+	hashAlgorithmsMutex.Lock()
+	defer hashAlgorithmsMutex.Unlock()
+	hashAlgorithms[name] = newFunc
+}
+
+// NewHash returns new hash for the given algorithm. Empty algorithm means the DefaultHashAlgorithm.
+func NewHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	if len(algorithm) == 0 {
+		algorithm = DefaultHashAlgorithm
+	}
+	hashAlgorithmsMutex.RLock()
+	defer hashAlgorithmsMutex.RUnlock()
+	newFunc, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownHashAlgorithm, "%q", algorithm)
+	}
+	return newFunc(), nil
+}
+
+// Digest is the hash of the file content in "algorithm:hex" format (eg. "sha256:2c26b46b...").
+type Digest string
+
+func NewDigest(algorithm HashAlgorithm, sum []byte) Digest {
+	if len(algorithm) == 0 {
+		algorithm = DefaultHashAlgorithm
+	}
+	return Digest(string(algorithm) + ":" + hex.EncodeToString(sum))
+}
+
+// ComputeDigest streams the reader into the hash and returns the digest.
+func ComputeDigest(algorithm HashAlgorithm, r io.Reader) (Digest, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return NewDigest(algorithm, h.Sum(nil)), nil
+}
+
+func (d Digest) Algorithm() HashAlgorithm {
+	if i := strings.Index(string(d), ":"); i >= 0 {
+		return HashAlgorithm(d[:i])
+	}
+	return ""
+}
+
+// Hex returns the hex encoded hash without the algorithm prefix.
+func (d Digest) Hex() string {
+	if i := strings.Index(string(d), ":"); i >= 0 {
+		return string(d[i+1:])
+	}
+	return string(d)
+}
+
+func (d Digest) String() string {
+	return string(d)
+}
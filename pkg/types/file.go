@@ -1,50 +1,300 @@
 package types
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"fmt"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
 )
 
 type File interface {
 	Name() string
 
+	// Stat returns the file information following the symlinks.
 	Stat() os.FileInfo
+	// Lstat returns the file information of the file name itself, which might be a symlink.
+	Lstat() os.FileInfo
+	Metadata() Metadata
+
+	// Open returns reader for the on-disk file content.
+	Open() (io.ReadCloser, error)
 
+	// Content returns the file content or nil when the content can't be read.
 	Content() []byte
+	// ReadContent returns the file content and the error that occurred while reading it.
+	ReadContent() ([]byte, error)
+	// Digest returns the hash of the content computed by the algorithm set in the file options.
+	Digest() Digest
 	ContentSum256() string
+
+	// Revision is the store revision the file was observed at. Files that were not stored have zero revision.
+	Revision() uint64
+}
+
+// SharedContent is implemented by the files holding their content in memory. It allows the store to keep
+// a single copy of identical content.
+type SharedContent interface {
+	// ResidentContent returns the content when it is held in memory.
+	ResidentContent() ([]byte, bool)
+	// ShareContent replaces the content held in memory with the identical shared content. The caller must
+	// compare the content, the equal digests do not guarantee identical content.
+	ShareContent(content []byte)
 }
 
+// ContentRetainer is implemented by the files that might hold their content in the ContentCache. The files
+// that are not stored hold the content read on creation themselves. The store moves the content to the cache
+// when it retains the file version and releases it when the version is no longer retained.
+type ContentRetainer interface {
+	RetainContent()
+	ReleaseContent()
+}
+
+// ContentMode controls when the file content is read and whether it is kept in memory.
+type ContentMode int
+
+const (
+	// ContentModeEager reads the content when the file is created (default).
+	ContentModeEager ContentMode = iota
+	// ContentModeLazy reads the content on the first access and keeps it.
+	ContentModeLazy
+	// ContentModeMetadataOnly keeps only the os.FileInfo and the content hash. The content is read
+	// from disk on every access.
+	ContentModeMetadataOnly
+)
+
+type FileOptions struct {
+	ContentMode ContentMode
+
+	// MaxContentSize is the maximum size of the file content that can be read into memory. Reading
+	// larger files fails with ErrTooLarge. Zero means no limit.
+	// In ContentModeMetadataOnly the larger files are added as the content is never kept, only ReadContent
+	// fails with ErrTooLarge.
+	MaxContentSize int64
+
+	// HashAlgorithm is the algorithm used to compute the file digest. Defaults to SHA256.
+	HashAlgorithm HashAlgorithm
+
+	// Paranoid makes RefreshFile read and hash the content even when the file metadata did not change.
+	Paranoid bool
+
+	// SymlinkPolicy controls how the symlinks are read and watched. Defaults to SymlinkFollow.
+	SymlinkPolicy SymlinkPolicy
+
+	// ContentCache limits the memory used by the content of eager and lazy files. The files sharing the cache
+	// keep their content only while it fits the cache budget.
+	ContentCache *ContentCache
+
+	// FS is the filesystem the files are read from. Defaults to the OS filesystem.
+	FS filesystem.FS
+}
+
+// SymlinkPolicy controls how a file name that is a symlink is treated.
+type SymlinkPolicy int
+
+const (
+	// SymlinkFollow reads the final target of the symlink. The informer watches the target and re-resolve
+	// the symlink when it change.
+	SymlinkFollow SymlinkPolicy = iota
+	// SymlinkNoFollow treats the symlink itself as the object, the content is the symlink target.
+	SymlinkNoFollow
+	// SymlinkChain follows the symlink like SymlinkFollow, but the informer watches every hop in the chain.
+	SymlinkChain
+)
+
 type localFile struct {
-	name    string
+	name     string
+	stat     os.FileInfo
+	lstat    os.FileInfo
+	metadata Metadata
+	options  FileOptions
+
+	// digest and sum caches the content hashes
+	digestOnce sync.Once
+	digest     Digest
+	digestErr  error
+	sumOnce    sync.Once
+	sum        string
+
+	mutex   sync.Mutex
 	content []byte
-	stat    os.FileInfo
+	loaded  bool
+	// cacheState tracks whether the content is kept in the ContentCache
+	cacheState cacheState
 }
 
+type cacheState int
+
+const (
+	// contentNotRetained is the file that was not stored, the content is held by the file
+	contentNotRetained cacheState = iota
+	// contentRetained is the stored file, the content is kept in the ContentCache
+	contentRetained
+	// contentReleased is the file no longer retained by the store, the content is read from disk
+	contentReleased
+)
+
 var (
 	ErrIsDirectory = errors.New("is a directory")
+	ErrTooLarge    = errors.New("file is too large")
+	// ErrContentChanged is returned when the content is read from disk, but the file changed since the file
+	// version was created.
+	ErrContentChanged = errors.New("file content changed since it was read")
 )
 
 func NewFile(fileName string) (File, error) {
-	stat, err := os.Stat(fileName)
+	return NewFileWithOptions(fileName, FileOptions{})
+}
+
+func NewFileWithOptions(fileName string, options FileOptions) (File, error) {
+	if _, err := NewHash(options.HashAlgorithm); err != nil {
+		return nil, err
+	}
+	fsys := filesystem.Default(options.FS)
+	stat, err := statFile(fsys, fileName, options.SymlinkPolicy)
 	if err != nil {
 		return nil, err
 	}
 	if stat.IsDir() {
 		return nil, ErrIsDirectory
 	}
-	content, err := ioutil.ReadFile(fileName)
+	lstat, err := fsys.Lstat(fileName)
 	if err != nil {
 		return nil, err
 	}
-	return &localFile{
-		name:    fileName,
-		content: content,
-		stat:    stat,
-	}, nil
+	metadata := newMetadata(stat)
+	if lstat.Mode()&os.ModeSymlink != 0 {
+		if metadata.LinkTarget, err = fsys.Readlink(fileName); err != nil {
+			return nil, err
+		}
+		if options.SymlinkPolicy != SymlinkNoFollow {
+			if metadata.LinkChain, metadata.ResolvedTarget, err = resolveLinkChain(fsys, fileName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if filesystem.IsOS(fsys) && (options.SymlinkPolicy != SymlinkNoFollow || len(metadata.LinkTarget) == 0) {
+		metadata.Xattrs = readXattrs(fileName)
+	}
+	f := &localFile{
+		name:     fileName,
+		stat:     stat,
+		lstat:    lstat,
+		metadata: metadata,
+		options:  options,
+	}
+	if options.ContentMode == ContentModeEager {
+		content, err := f.read()
+		if err != nil {
+			return nil, err
+		}
+		f.content, f.loaded = content, true
+		if options.ContentCache == nil {
+			return f, nil
+		}
+		// The digest is needed to verify the content reloaded after eviction
+		f.digestOnce.Do(func() { f.digest, f.digestErr = ComputeDigest(options.HashAlgorithm, bytes.NewReader(content)) })
+		if f.digestErr != nil {
+			return nil, f.digestErr
+		}
+		return f, nil
+	}
+	if options.ContentMode == ContentModeLazy && f.exceedsMaxContentSize(stat.Size()) {
+		return nil, ErrTooLarge
+	}
+	// Lazy and metadata-only files stream the content to compute the digest, so the change detection
+	// works without holding the content in memory.
+	f.digestOnce.Do(func() { f.digest, f.digestErr = f.streamDigest(options.HashAlgorithm) })
+	if f.digestErr != nil {
+		return nil, f.digestErr
+	}
+	return f, nil
+}
+
+// SameInode returns true when the file name is the same inode as the file. The file name is stat'ed by the
+// symlink policy, the content is not read, so the renamed files can be paired without reading the candidates.
+func SameInode(f File, fileName string, options FileOptions) (bool, error) {
+	stat, err := statFile(filesystem.Default(options.FS), fileName, options.SymlinkPolicy)
+	if err != nil {
+		return false, err
+	}
+	if stat.IsDir() {
+		return false, nil
+	}
+	if inode := f.Metadata().Inode; inode != 0 {
+		m := newMetadata(stat)
+		return m.Inode == inode && m.Device == f.Metadata().Device, nil
+	}
+	return os.SameFile(f.Stat(), stat), nil
+}
+
+// RefreshFile returns the current version of the file. When the old file is given and its metadata (size,
+// modification and change time, inode) match the on-disk file, the old file is returned without reading
+// and hashing the content, unless the Paranoid option is set.
+// The changed is true when the content of the file differs from the old file.
+func RefreshFile(old File, fileName string, options FileOptions) (f File, changed bool, err error) {
+	if old != nil && !options.Paranoid {
+		stat, err := statFile(filesystem.Default(options.FS), fileName, options.SymlinkPolicy)
+		if err != nil {
+			return nil, false, err
+		}
+		if !stat.IsDir() && old.Metadata().Equal(newMetadata(stat)) {
+			return old, false, nil
+		}
+	}
+	f, err = NewFileWithOptions(fileName, options)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, old == nil || Changed(old, f), nil
+}
+
+// Changed returns true when the file content or the resolved symlink target differs.
+func Changed(old, f File) bool {
+	return old.Digest() != f.Digest() || old.Metadata().ResolvedTarget != f.Metadata().ResolvedTarget
+}
+
+func statFile(fsys filesystem.FS, fileName string, policy SymlinkPolicy) (os.FileInfo, error) {
+	if policy == SymlinkNoFollow {
+		return fsys.Lstat(fileName)
+	}
+	return fsys.Stat(fileName)
+}
+
+// maxLinkChain is the maximum number of symlinks followed, matching the Linux MAXSYMLINKS
+const maxLinkChain = 40
+
+// resolveLinkChain returns all symlinks in the chain starting with the file name and the final target.
+func resolveLinkChain(fsys filesystem.FS, fileName string) ([]string, string, error) {
+	var chain []string
+	current := fileName
+	for i := 0; i < maxLinkChain; i++ {
+		lstat, err := fsys.Lstat(current)
+		if err != nil {
+			return nil, "", err
+		}
+		if lstat.Mode()&os.ModeSymlink == 0 {
+			return chain, current, nil
+		}
+		chain = append(chain, current)
+		target, err := fsys.Readlink(current)
+		if err != nil {
+			return nil, "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(current), target)
+		}
+		current = filepath.Clean(target)
+	}
+	return nil, "", errors.Errorf("%s: too many levels of symbolic links", fileName)
 }
 
 func (f *localFile) Name() string {
@@ -55,10 +305,241 @@ func (f *localFile) Stat() os.FileInfo {
 	return f.stat
 }
 
+func (f *localFile) Revision() uint64 {
+	return 0
+}
+
+func (f *localFile) Lstat() os.FileInfo {
+	return f.lstat
+}
+
+func (f *localFile) Metadata() Metadata {
+	return f.metadata
+}
+
+func (f *localFile) Open() (io.ReadCloser, error) {
+	if f.options.SymlinkPolicy == SymlinkNoFollow && len(f.metadata.LinkTarget) > 0 {
+		return ioutil.NopCloser(strings.NewReader(f.metadata.LinkTarget)), nil
+	}
+	return filesystem.Default(f.options.FS).Open(f.name)
+}
+
 func (f *localFile) Content() []byte {
-	return f.content
+	content, _ := f.ReadContent()
+	return content
+}
+
+// ReadContent returns the content of the file version. The lazy and metadata-only files read the content
+// from disk, which fails with ErrContentChanged when the file changed since the version was created.
+func (f *localFile) ReadContent() ([]byte, error) {
+	if f.options.ContentMode == ContentModeMetadataOnly {
+		content, err := f.read()
+		if err != nil {
+			return nil, err
+		}
+		if err := f.verify(content); err != nil {
+			return nil, err
+		}
+		return content, nil
+	}
+	if f.options.ContentCache != nil {
+		return f.readCached(f.options.ContentCache)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.loaded {
+		return f.content, nil
+	}
+	content, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.verify(content); err != nil {
+		return nil, err
+	}
+	f.content, f.loaded = content, true
+	return f.content, nil
+}
+
+func (f *localFile) ResidentContent() ([]byte, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.content, f.loaded
+}
+
+func (f *localFile) ShareContent(content []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.loaded && len(f.content) == len(content) {
+		f.content = content
+	}
+}
+
+// RetainContent moves the content held by the file to the content cache. The content evicted from the cache
+// is read again from disk when needed.
+func (f *localFile) RetainContent() {
+	if f.options.ContentCache == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.loaded {
+		f.options.ContentCache.put(f, f.content)
+		f.content, f.loaded = nil, false
+	}
+	f.cacheState = contentRetained
+}
+
+// ReleaseContent evicts the content from the content cache. The content is read again from disk when needed,
+// but it is no longer cached.
+func (f *localFile) ReleaseContent() {
+	if f.options.ContentCache == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.options.ContentCache.evict(f)
+	f.content, f.loaded = nil, false
+	f.cacheState = contentReleased
+}
+
+// WithoutContent returns the version of the file that does not hold the content. The content is read from disk
+// and verified by the digest when needed, so it fails with ErrContentChanged after the file changed. The files
+// keeping their content in the ContentCache are returned as they are, their content is limited by the cache
+// budget.
+func WithoutContent(f File) File {
+	l, ok := Unwrap(f).(*localFile)
+	if !ok || l.options.ContentCache != nil || l.options.ContentMode == ContentModeMetadataOnly {
+		return f
+	}
+	c := &localFile{
+		name:     l.name,
+		stat:     l.stat,
+		lstat:    l.lstat,
+		metadata: l.metadata,
+		options:  l.options,
+	}
+	c.options.ContentMode = ContentModeMetadataOnly
+	c.digest = l.Digest()
+	c.digestErr = l.digestErr
+	c.digestOnce.Do(func() {})
+	if f.Revision() == 0 {
+		return c
+	}
+	return WithRevision(c, f.Revision())
+}
+
+// readCached returns the content of the file sharing the content cache. Only the content of the retained
+// files is kept in the cache, the files that were not stored yet hold their content themselves.
+func (f *localFile) readCached(c *ContentCache) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.loaded {
+		return f.content, nil
+	}
+	if f.cacheState == contentRetained {
+		if content, ok := c.get(f); ok {
+			return content, nil
+		}
+	}
+	content, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.verify(content); err != nil {
+		return nil, err
+	}
+	switch f.cacheState {
+	case contentRetained:
+		c.put(f, content)
+	case contentNotRetained:
+		f.content, f.loaded = content, true
+	}
+	return content, nil
+}
+
+// verify returns ErrContentChanged when the content read from disk does not match the digest recorded when
+// the file was created. Only the files with the digest computed on creation can be verified.
+func (f *localFile) verify(content []byte) error {
+	digest, err := ComputeDigest(f.options.HashAlgorithm, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if digest != f.Digest() {
+		return errors.Wrap(ErrContentChanged, f.name)
+	}
+	return nil
+}
+
+func (f *localFile) Digest() Digest {
+	f.digestOnce.Do(func() {
+		content, err := f.ReadContent()
+		if err != nil {
+			f.digestErr = err
+			return
+		}
+		f.digest, f.digestErr = ComputeDigest(f.options.HashAlgorithm, bytes.NewReader(content))
+	})
+	return f.digest
 }
 
 func (f *localFile) ContentSum256() string {
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(string(f.Content()))))
+	f.sumOnce.Do(func() {
+		if d := f.Digest(); d.Algorithm() == SHA256 {
+			f.sum = d.Hex()
+			return
+		}
+		if f.options.ContentMode == ContentModeEager {
+			sum := sha256.Sum256(f.Content())
+			f.sum = hex.EncodeToString(sum[:])
+			return
+		}
+		if d, err := f.streamDigest(SHA256); err == nil {
+			f.sum = d.Hex()
+		}
+	})
+	return f.sum
+}
+
+func (f *localFile) exceedsMaxContentSize(size int64) bool {
+	return f.options.MaxContentSize > 0 && size > f.options.MaxContentSize
+}
+
+// read reads the file content honoring the max content size. The file might grow after it was stat-ed,
+// so the limit is also enforced while reading.
+func (f *localFile) read() ([]byte, error) {
+	if f.options.MaxContentSize == 0 {
+		return f.readAll()
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(r, f.options.MaxContentSize+1)); err != nil {
+		return nil, err
+	}
+	if f.exceedsMaxContentSize(int64(buf.Len())) {
+		return nil, ErrTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *localFile) readAll() ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (f *localFile) streamDigest(algorithm HashAlgorithm) (Digest, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return ComputeDigest(algorithm, r)
 }
@@ -0,0 +1,377 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/filesystem"
+)
+
+func TestNewFileWithOptions(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo content"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		options     FileOptions
+		wantErr     error
+		wantReadErr error
+		wantContent string
+	}{
+		{
+			name:        "eager",
+			options:     FileOptions{},
+			wantContent: "foo content",
+		},
+		{
+			name:        "lazy",
+			options:     FileOptions{ContentMode: ContentModeLazy},
+			wantContent: "foo content",
+		},
+		{
+			name:        "metadata only",
+			options:     FileOptions{ContentMode: ContentModeMetadataOnly},
+			wantContent: "foo content",
+		},
+		{
+			name:        "metadata only too large",
+			options:     FileOptions{ContentMode: ContentModeMetadataOnly, MaxContentSize: 3},
+			wantReadErr: ErrTooLarge,
+		},
+		{
+			name:    "eager too large",
+			options: FileOptions{MaxContentSize: 3},
+			wantErr: ErrTooLarge,
+		},
+		{
+			name:    "lazy too large",
+			options: FileOptions{ContentMode: ContentModeLazy, MaxContentSize: 3},
+			wantErr: ErrTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFileWithOptions(fooFilePath, tt.options)
+			if err != tt.wantErr {
+				t.Fatalf("NewFileWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := f.ReadContent(); err != tt.wantReadErr {
+				t.Errorf("ReadContent() error = %v, wantReadErr %v", err, tt.wantReadErr)
+			}
+			if got := string(f.Content()); got != tt.wantContent {
+				t.Errorf("Content() = %q, want %q", got, tt.wantContent)
+			}
+			eager, _ := NewFile(fooFilePath)
+			if f.ContentSum256() != eager.ContentSum256() {
+				t.Errorf("ContentSum256() = %q, want %q", f.ContentSum256(), eager.ContentSum256())
+			}
+		})
+	}
+}
+
+func TestRefreshFile(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	old, err := NewFile(fooFilePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f, changed, err := RefreshFile(old, fooFilePath, FileOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed || f != old {
+		t.Errorf("expected unchanged file to be returned as is")
+	}
+	f, changed, err = RefreshFile(old, fooFilePath, FileOptions{Paranoid: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed || f == old {
+		t.Errorf("expected paranoid refresh to read the file again without change")
+	}
+
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	f, changed, err = RefreshFile(old, fooFilePath, FileOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !changed || string(f.Content()) != "updated foo" {
+		t.Errorf("expected changed file with 'updated foo', got %q", string(f.Content()))
+	}
+
+	// Filesystems without the change time still report the mode change
+	mapFS := fstest.MapFS{"foo": {Data: []byte("foo"), Mode: 0644}}
+	options := FileOptions{FS: filesystem.FromIOFS(mapFS)}
+	old, err = NewFileWithOptions("/foo", options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mapFS["foo"].Mode = 0600
+	f, changed, err = RefreshFile(old, "/foo", options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed || f == old || f.Metadata().Mode != 0600 {
+		t.Errorf("expected unchanged content with new mode, got changed %v, mode %v", changed, f.Metadata().Mode)
+	}
+}
+
+func TestFileDigest(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		options FileOptions
+		want    Digest
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+		{
+			name:    "sha512 streamed",
+			options: FileOptions{HashAlgorithm: SHA512, ContentMode: ContentModeMetadataOnly},
+			want:    "sha512:f7fbba6e0636f890e56fbbf3283e524c6fa3204ae298382d624741d0dc6638326e282c41be5e4254d8820772c5518a2c5a8c0c7f7eda19594a7eb539453e1ed7",
+		},
+		{
+			name:    "crc32c",
+			options: FileOptions{HashAlgorithm: CRC32C},
+			want:    "crc32c:cfc4ae1d",
+		},
+		{
+			name:    "unknown",
+			options: FileOptions{HashAlgorithm: "md4"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFileWithOptions(fooFilePath, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFileWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := f.Digest(); got != tt.want {
+				t.Errorf("Digest() = %q, want %q", got, tt.want)
+			}
+			if got := f.ContentSum256(); got != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+				t.Errorf("ContentSum256() = %q", got)
+			}
+		})
+	}
+}
+
+func TestContentCache(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	content := func(name string) string {
+		return strings.Repeat(name, 32)
+	}
+	cache := NewContentCache(200)
+	options := FileOptions{ContentCache: cache}
+	var files []File
+	for _, name := range []string{"foo", "bar", "baz"} {
+		path := filepath.Join(baseDir, name)
+		if err := ioutil.WriteFile(path, []byte(content(name)), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		before := cache.Stats()
+		f, err := NewFileWithOptions(path, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The content is cached only when the file is retained by the store
+		if stats := cache.Stats(); stats != before {
+			t.Errorf("expected the content of %q not cached before retained, got %+v", name, stats)
+		}
+		f.(ContentRetainer).RetainContent()
+		files = append(files, f)
+	}
+	if stats := cache.Stats(); stats.Size != 192 || stats.Files != 2 || stats.Evictions != 1 {
+		t.Errorf("expected foo evicted, got %+v", stats)
+	}
+
+	// Evicted content is reloaded and evicts the least recently used bar
+	if got, err := files[0].ReadContent(); err != nil || string(got) != content("foo") {
+		t.Errorf("expected foo content, got %q (%v)", got, err)
+	}
+	if got := files[2].Content(); string(got) != content("baz") {
+		t.Errorf("expected baz content, got %q", got)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if err := ioutil.WriteFile(files[1].Name(), []byte("changed"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if _, err := files[1].ReadContent(); errors.Cause(err) != ErrContentChanged {
+		t.Errorf("expected ErrContentChanged, got %v", err)
+	}
+
+	// Empty files use the minimum entry cost
+	emptyPath := filepath.Join(baseDir, "empty")
+	if err := ioutil.WriteFile(emptyPath, nil, 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		f, err := NewFileWithOptions(emptyPath, options)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		f.(ContentRetainer).RetainContent()
+	}
+	if stats := cache.Stats(); stats.Size > stats.Budget || stats.Files != 3 {
+		t.Errorf("expected the empty files within the budget, got %+v", stats)
+	}
+
+	// Released content is evicted and read from disk
+	files[2].(ContentRetainer).ReleaseContent()
+	if _, ok := cache.get(files[2].(*localFile)); ok {
+		t.Errorf("expected the released content evicted")
+	}
+	if got := files[2].Content(); string(got) != content("baz") {
+		t.Errorf("expected baz content, got %q", got)
+	}
+	if _, ok := cache.get(files[2].(*localFile)); ok {
+		t.Errorf("expected the released content not cached again")
+	}
+
+	// The files that are not retained keep their content out of the cache
+	before := cache.Stats()
+	transient, err := NewFileWithOptions(filepath.Join(baseDir, "foo"), options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := transient.Content(); string(got) != content("foo") {
+		t.Errorf("expected foo content, got %q", got)
+	}
+	if stats := cache.Stats(); stats.Files != before.Files || stats.Evictions != before.Evictions {
+		t.Errorf("expected the transient file not cached, got %+v", stats)
+	}
+}
+
+func TestReadContentChanged(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	tests := []struct {
+		name        string
+		mode        ContentMode
+		wantErr     error
+		wantContent string
+	}{
+		{name: "eager", mode: ContentModeEager, wantContent: "old"},
+		{name: "lazy", mode: ContentModeLazy, wantErr: ErrContentChanged},
+		{name: "metadata only", mode: ContentModeMetadataOnly, wantErr: ErrContentChanged},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(baseDir, test.name)
+			if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+				t.Fatalf("unable to write file: %v", err)
+			}
+			f, err := NewFileWithOptions(path, FileOptions{ContentMode: test.mode})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The old version must not return the content of the new version
+			if err := ioutil.WriteFile(path, []byte("new"), 0644); err != nil {
+				t.Fatalf("unable to write file: %v", err)
+			}
+			content, err := f.ReadContent()
+			if errors.Cause(err) != test.wantErr {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if string(content) != test.wantContent {
+				t.Errorf("expected content %q, got %q", test.wantContent, content)
+			}
+		})
+	}
+}
+
+func TestWithoutContent(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	path := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stripped := WithoutContent(WithRevision(f, 3))
+	if _, resident := Unwrap(stripped).(*localFile).ResidentContent(); resident {
+		t.Errorf("expected no resident content")
+	}
+	if stripped.Digest() != f.Digest() || stripped.Revision() != 3 || stripped.Name() != path {
+		t.Errorf("expected the digest, revision and name preserved")
+	}
+	if content, err := stripped.ReadContent(); err != nil || string(content) != "old" {
+		t.Errorf("expected content read from disk, got %q: %v", content, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if _, err := stripped.ReadContent(); errors.Cause(err) != ErrContentChanged {
+		t.Errorf("expected ErrContentChanged, got %v", err)
+	}
+
+	// The cached content is limited by the cache budget
+	cached, err := NewFileWithOptions(path, FileOptions{ContentCache: NewContentCache(1024)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if WithoutContent(cached) != cached {
+		t.Errorf("expected the cached file returned as it is")
+	}
+}
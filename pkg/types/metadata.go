@@ -0,0 +1,100 @@
+package types
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/sysstat"
+)
+
+// SELinuxXattr is the extended attribute holding the SELinux label.
+const SELinuxXattr = "security.selinux"
+
+// Metadata holds the file attributes. The size, times, inode and device are used to detect changes without
+// reading the file content.
+type Metadata struct {
+	Size       int64
+	ModTime    time.Time
+	ChangeTime time.Time
+	Inode      uint64
+	Device     uint64
+
+	// Mode is the permission bits (including setuid, setgid and sticky) of the file
+	Mode  os.FileMode
+	UID   uint32
+	GID   uint32
+	Links uint64
+
+	// LinkTarget is the symlink target when the file name is a symlink
+	LinkTarget string
+	// LinkChain is the list of symlinks followed to resolve the file name, starting with the file name
+	LinkChain []string
+	// ResolvedTarget is the final target of the symlink chain
+	ResolvedTarget string
+	Xattrs         map[string][]byte
+}
+
+// InodeFileInfo is implemented by the file information Sys() of the filesystems without the syscall stat
+// (eg. the in-memory filesystem) to report the file identity, so the renames can be paired.
+type InodeFileInfo interface {
+	Inode() uint64
+}
+
+func newMetadata(stat os.FileInfo) Metadata {
+	m := Metadata{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Mode:    stat.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+	}
+	// The inode, ownership and change time are not available on every platform
+	if sys, ok := sysstat.FromFileInfo(stat); ok {
+		m.ChangeTime = sys.ChangeTime
+		m.Inode = sys.Inode
+		m.Device = sys.Device
+		m.UID = sys.UID
+		m.GID = sys.GID
+		m.Links = sys.Links
+	}
+	if sys, ok := stat.Sys().(InodeFileInfo); ok {
+		m.Inode = sys.Inode()
+	}
+	return m
+}
+
+// Equal returns true when both metadata describe the same on-disk state of a file. The mode and ownership
+// are compared as well, as not every filesystem reports the change time that chmod and chown update.
+func (m Metadata) Equal(other Metadata) bool {
+	return m.Size == other.Size &&
+		m.ModTime.Equal(other.ModTime) &&
+		m.ChangeTime.Equal(other.ChangeTime) &&
+		m.Inode == other.Inode &&
+		m.Device == other.Device &&
+		m.Mode == other.Mode &&
+		m.UID == other.UID &&
+		m.GID == other.GID
+}
+
+// AttributesEqual returns true when the ownership, permissions, symlink target and extended attributes
+// are the same. These can change without changing the file content (chmod, chown, setfattr).
+func (m Metadata) AttributesEqual(other Metadata) bool {
+	if m.Mode != other.Mode || m.UID != other.UID || m.GID != other.GID || m.LinkTarget != other.LinkTarget {
+		return false
+	}
+	if len(m.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for name, value := range m.Xattrs {
+		otherValue, ok := other.Xattrs[name]
+		if !ok || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// SELinuxLabel returns the SELinux label of the file or empty string when the file is not labeled.
+func (m Metadata) SELinuxLabel() string {
+	return strings.TrimRight(string(m.Xattrs[SELinuxXattr]), "\x00")
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package types
+
+func readXattrs(_ string) map[string][]byte {
+	return nil
+}
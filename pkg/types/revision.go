@@ -0,0 +1,31 @@
+package types
+
+// revisionedFile is the file with the store revision it was observed at.
+type revisionedFile struct {
+	File
+	revision uint64
+}
+
+// WithRevision returns the file that reports the given revision.
+func WithRevision(f File, revision uint64) File {
+	return &revisionedFile{File: Unwrap(f), revision: revision}
+}
+
+func (f *revisionedFile) Revision() uint64 {
+	return f.revision
+}
+
+func (f *revisionedFile) Unwrap() File {
+	return f.File
+}
+
+// Unwrap returns the underlying file when the file was wrapped (eg. by WithRevision).
+func Unwrap(f File) File {
+	for {
+		w, ok := f.(interface{ Unwrap() File })
+		if !ok {
+			return f
+		}
+		f = w.Unwrap()
+	}
+}
@@ -1,15 +1,39 @@
 package types
 
+import "time"
+
 type FileEventHandler interface {
 	OnAdd(obj interface{})
 	OnUpdate(oldObj, newObj interface{})
 	OnDelete(obj interface{})
 }
 
+// MetadataUpdateHandler is the optional FileEventHandler notified when the file ownership, permissions or
+// extended attributes changed without the content change.
+type MetadataUpdateHandler interface {
+	OnMetadataUpdate(oldObj, newObj interface{})
+}
+
+// RenameHandler is the optional FileEventHandler notified when the watched file was moved to other watched
+// path. The handlers without OnRename observe the rename as the delete and the add.
+type RenameHandler interface {
+	OnRename(oldObj, newObj interface{})
+}
+
+var (
+	_ FileEventHandler      = FileEventHandlerFuncs{}
+	_ MetadataUpdateHandler = FileEventHandlerFuncs{}
+	_ RenameHandler         = FileEventHandlerFuncs{}
+)
+
 type FileEventHandlerFuncs struct {
-	AddFunc    func(obj interface{})
-	UpdateFunc func(oldObj, newObj interface{})
-	DeleteFunc func(obj interface{})
+	AddFunc            func(obj interface{})
+	UpdateFunc         func(oldObj, newObj interface{})
+	MetadataUpdateFunc func(oldObj, newObj interface{})
+	DeleteFunc         func(obj interface{})
+	// RenameFunc is called when the file was moved between the watched paths. When not set, the rename is
+	// delivered as the delete of the old file and the add of the new file.
+	RenameFunc func(oldObj, newObj interface{})
 }
 
 func (r FileEventHandlerFuncs) OnAdd(obj interface{}) {
@@ -24,14 +48,58 @@ func (r FileEventHandlerFuncs) OnUpdate(oldObj, newObj interface{}) {
 	}
 }
 
+func (r FileEventHandlerFuncs) OnMetadataUpdate(oldObj, newObj interface{}) {
+	if r.MetadataUpdateFunc != nil {
+		r.MetadataUpdateFunc(oldObj, newObj)
+	}
+}
+
 func (r FileEventHandlerFuncs) OnDelete(obj interface{}) {
 	if r.DeleteFunc != nil {
 		r.DeleteFunc(obj)
 	}
 }
 
+func (r FileEventHandlerFuncs) OnRename(oldObj, newObj interface{}) {
+	if r.RenameFunc != nil {
+		r.RenameFunc(oldObj, newObj)
+		return
+	}
+	r.OnDelete(oldObj)
+	r.OnAdd(newObj)
+}
+
+// FileGroup declares a set of related files (eg. certificate and key) that are updated together.
+// Instead of per-file events, the group is delivered once all members settle.
+type FileGroup struct {
+	Name  string
+	Paths []string
+
+	// QuietPeriod is the time all members must stay unchanged before the group update is delivered.
+	QuietPeriod time.Duration
+
+	// ConsistentFunc is optional predicate that must return true for the new snapshot of the group
+	// members before it is delivered. Members that does not exist on disk are not in the map.
+	ConsistentFunc func(files map[string]File) bool
+}
+
+type FileGroupEventHandler interface {
+	OnGroupUpdate(group string, oldFiles, newFiles map[string]File)
+}
+
+type FileGroupEventHandlerFuncs struct {
+	UpdateFunc func(group string, oldFiles, newFiles map[string]File)
+}
+
+func (r FileGroupEventHandlerFuncs) OnGroupUpdate(group string, oldFiles, newFiles map[string]File) {
+	if r.UpdateFunc != nil {
+		r.UpdateFunc(group, oldFiles, newFiles)
+	}
+}
+
 type FileInformer interface {
 	AddEventHandler(handler FileEventHandlerFuncs)
+	AddGroupEventHandler(group FileGroup, handler FileGroupEventHandlerFuncs)
 	Run(stopCh <-chan struct{})
 	HasSynced() bool
 }
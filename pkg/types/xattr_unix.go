@@ -0,0 +1,39 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package types
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file. Failures (eg. filesystem without xattr support)
+// are treated as no attributes.
+func readXattrs(fileName string) map[string][]byte {
+	size, err := unix.Listxattr(fileName, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(fileName, buf); err != nil {
+		return nil
+	}
+	xattrs := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		valueSize, err := unix.Getxattr(fileName, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Getxattr(fileName, string(name), value); err != nil {
+			continue
+		}
+		xattrs[string(name)] = value[:valueSize]
+	}
+	return xattrs
+}
@@ -0,0 +1,112 @@
+package watch
+
+import (
+	"sync"
+)
+
+// fallbackBackend watches the paths using the primary backend and falls back to the secondary backend for
+// the paths the primary backend can't watch (eg. inotify on NFS or exhausted inotify watches).
+type fallbackBackend struct {
+	primary  Backend
+	fallback Backend
+
+	mutex         sync.Mutex
+	fallbackPaths map[string]bool
+
+	events    chan Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// WithFallback returns the backend that uses the fallback backend for the paths the primary backend fails
+// to add.
+func WithFallback(primary, fallback Backend) Backend {
+	b := &fallbackBackend{
+		primary:       primary,
+		fallback:      fallback,
+		fallbackPaths: map[string]bool{},
+		events:        make(chan Event),
+		errors:        make(chan error),
+		done:          make(chan struct{}),
+	}
+	go b.forward(primary)
+	go b.forward(fallback)
+	return b
+}
+
+func (b *fallbackBackend) forward(backend Backend) {
+	for {
+		select {
+		case event, ok := <-backend.Events():
+			if !ok {
+				return
+			}
+			select {
+			case b.events <- event:
+			case <-b.done:
+				return
+			}
+		case err, ok := <-backend.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case b.errors <- err:
+			case <-b.done:
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *fallbackBackend) Add(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.fallbackPaths[name] {
+		return nil
+	}
+	err := b.primary.Add(name)
+	if err == nil {
+		return nil
+	}
+	if fallbackErr := b.fallback.Add(name); fallbackErr != nil {
+		return err
+	}
+	b.fallbackPaths[name] = true
+	return nil
+}
+
+func (b *fallbackBackend) Remove(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.fallbackPaths[name] {
+		delete(b.fallbackPaths, name)
+		return b.fallback.Remove(name)
+	}
+	return b.primary.Remove(name)
+}
+
+func (b *fallbackBackend) Events() <-chan Event {
+	return b.events
+}
+
+func (b *fallbackBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *fallbackBackend) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		if primaryErr := b.primary.Close(); primaryErr != nil {
+			err = primaryErr
+		}
+		if fallbackErr := b.fallback.Close(); fallbackErr != nil {
+			err = fallbackErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,114 @@
+package watch
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type fsnotifyBackend struct {
+	watcher   *fsnotify.Watcher
+	events    chan Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFSNotify returns the backend using the fsnotify watcher (inotify on Linux).
+func NewFSNotify() (Backend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	b := &fsnotifyBackend{
+		watcher: watcher,
+		events:  make(chan Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *fsnotifyBackend) run() {
+	for {
+		select {
+		case event, ok := <-b.watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case b.events <- Event{Name: event.Name, Op: fromFSNotifyOp(event.Op)}:
+			case <-b.done:
+				return
+			}
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Report the overflow as event, matching the inotify backend
+			if err == fsnotify.ErrEventOverflow {
+				select {
+				case b.events <- Event{Op: Overflow}:
+				case <-b.done:
+					return
+				}
+				continue
+			}
+			select {
+			case b.errors <- err:
+			case <-b.done:
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// fsnotifyOps maps the fsnotify operations to the operations.
+var fsnotifyOps = []struct {
+	from fsnotify.Op
+	to   Op
+}{
+	{fsnotify.Create, Create},
+	{fsnotify.Write, Write},
+	{fsnotify.Remove, Remove},
+	{fsnotify.Rename, Rename},
+	{fsnotify.Chmod, Chmod},
+}
+
+func fromFSNotifyOp(op fsnotify.Op) Op {
+	var result Op
+	for _, o := range fsnotifyOps {
+		if op&o.from == o.from {
+			result |= o.to
+		}
+	}
+	return result
+}
+
+func (b *fsnotifyBackend) Add(name string) error {
+	return b.watcher.Add(name)
+}
+
+func (b *fsnotifyBackend) Remove(name string) error {
+	return b.watcher.Remove(name)
+}
+
+func (b *fsnotifyBackend) Events() <-chan Event {
+	return b.events
+}
+
+func (b *fsnotifyBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *fsnotifyBackend) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.watcher.Close()
+	})
+	return err
+}
@@ -0,0 +1,265 @@
+//go:build linux
+// +build linux
+
+package watch
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// InotifyOptions configures the inotify backend.
+type InotifyOptions struct {
+	// WriteOnClose reports the Write only when the file opened for writing is closed, so the handlers
+	// observe only complete files. The IN_MODIFY events are not reported. The Create of a new regular file is
+	// reported together with the close as well.
+	WriteOnClose bool
+}
+
+const inotifyMask = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_DELETE_SELF | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_MOVE_SELF
+
+type inotifyBackend struct {
+	// fd is used for adding the watches, calling file.Fd() would switch the file to blocking mode
+	fd      int
+	file    *os.File
+	options InotifyOptions
+
+	mutex sync.Mutex
+	// watches maps the watched path to the watch descriptor and back
+	watches map[string]int
+	paths   map[int]string
+	// pendingCreates are the new files not closed yet, their Create is reported on close with WriteOnClose
+	pendingCreates map[string]bool
+
+	events    chan Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewInotify returns the backend using inotify directly. Unlike fsnotify, it reports the close after write,
+// the queue overflow and unmount, and pairs the renames within the watched directories into a single Move
+// event. Only the rename halves read in the same batch are paired.
+func NewInotify(options InotifyOptions) (Backend, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	b := &inotifyBackend{
+		// The non-blocking descriptor is registered in the runtime poller, so closing the file unblocks the read
+		fd:             fd,
+		file:           os.NewFile(uintptr(fd), "inotify"),
+		options:        options,
+		watches:        map[string]int{},
+		paths:          map[int]string{},
+		pendingCreates: map[string]bool{},
+		events:         make(chan Event),
+		errors:         make(chan error),
+		done:           make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *inotifyBackend) Add(name string) error {
+	name = filepath.Clean(name)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, exists := b.watches[name]; exists {
+		return nil
+	}
+	mask := uint32(inotifyMask)
+	if b.options.WriteOnClose {
+		// The new file opened only for reading is closed without write
+		mask |= unix.IN_CLOSE_NOWRITE
+	}
+	wd, err := unix.InotifyAddWatch(b.fd, name, mask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: name, Err: err}
+	}
+	b.watches[name], b.paths[wd] = wd, name
+	return nil
+}
+
+func (b *inotifyBackend) Remove(name string) error {
+	name = filepath.Clean(name)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wd, exists := b.watches[name]
+	if !exists {
+		return nil
+	}
+	delete(b.watches, name)
+	delete(b.paths, wd)
+	if _, err := unix.InotifyRmWatch(b.fd, uint32(wd)); err != nil {
+		return &os.PathError{Op: "inotify_rm_watch", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (b *inotifyBackend) Events() <-chan Event {
+	return b.events
+}
+
+func (b *inotifyBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *inotifyBackend) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.file.Close()
+	})
+	return err
+}
+
+func (b *inotifyBackend) run() {
+	buf := make([]byte, 4096*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := b.file.Read(buf)
+		if err != nil {
+			select {
+			case <-b.done:
+			case b.errors <- err:
+			}
+			return
+		}
+		for _, event := range b.parse(buf[:n]) {
+			select {
+			case b.events <- event:
+			case <-b.done:
+				return
+			}
+		}
+	}
+}
+
+// parse converts the raw inotify events to events and pairs the rename halves.
+func (b *inotifyBackend) parse(buf []byte) []Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var events []Event
+	// movedFrom maps the rename cookie to the index of the unpaired MovedFrom event
+	movedFrom := map[uint32]int{}
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+		offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+		name := b.paths[int(raw.Wd)]
+		if entry := string(bytes.TrimRight(nameBytes, "\x00")); len(entry) > 0 {
+			name = filepath.Join(name, entry)
+		}
+		if raw.Mask&unix.IN_IGNORED != 0 {
+			// The watch was removed (eg. the file was deleted)
+			if path, exists := b.paths[int(raw.Wd)]; exists {
+				delete(b.watches, path)
+				delete(b.paths, int(raw.Wd))
+				for pending := range b.pendingCreates {
+					if filepath.Dir(pending) == path {
+						delete(b.pendingCreates, pending)
+					}
+				}
+				events = append(events, Event{Name: path, Op: Ignored})
+			}
+			continue
+		}
+		event := Event{Name: name, Op: b.op(raw.Mask), Cookie: raw.Cookie}
+		if b.options.WriteOnClose {
+			event.Op = b.deferCreate(name, raw.Mask, event.Op)
+		}
+		if raw.Mask&unix.IN_MOVED_TO != 0 {
+			if i, exists := movedFrom[raw.Cookie]; exists {
+				delete(movedFrom, raw.Cookie)
+				event = Event{Name: name, OldName: events[i].Name, Op: Move, Cookie: raw.Cookie}
+				events = append(events[:i], events[i+1:]...)
+				for cookie, j := range movedFrom {
+					if j > i {
+						movedFrom[cookie] = j - 1
+					}
+				}
+			}
+		}
+		if event.Op == 0 {
+			continue
+		}
+		if raw.Mask&unix.IN_MOVED_FROM != 0 {
+			movedFrom[raw.Cookie] = len(events)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// deferCreate holds the Create of the new regular file until the file is closed, so the handlers do not observe
+// the empty file. The Create is reported together with the close. The symlinks, directories and hard links
+// are reported immediately, as they are not opened for writing. Must be called with the mutex held.
+func (b *inotifyBackend) deferCreate(name string, mask uint32, op Op) Op {
+	switch {
+	case mask&unix.IN_CREATE != 0 && mask&unix.IN_ISDIR == 0 && isNewRegularFile(name):
+		b.pendingCreates[name] = true
+		return op &^ Create
+	case !b.pendingCreates[name]:
+		return op
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_CLOSE_NOWRITE) != 0:
+		delete(b.pendingCreates, name)
+		return op | Create
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		delete(b.pendingCreates, name)
+	}
+	return op
+}
+
+// isNewRegularFile returns true when the file is a regular file with a single link.
+func isNewRegularFile(name string) bool {
+	var stat unix.Stat_t
+	if err := unix.Lstat(name, &stat); err != nil {
+		return false
+	}
+	return stat.Mode&unix.S_IFMT == unix.S_IFREG && stat.Nlink == 1
+}
+
+func (b *inotifyBackend) op(mask uint32) Op {
+	var op Op
+	if mask&unix.IN_CREATE != 0 {
+		op |= Create
+	}
+	if mask&unix.IN_MODIFY != 0 && !b.options.WriteOnClose {
+		op |= Write
+	}
+	if mask&unix.IN_CLOSE_WRITE != 0 {
+		op |= CloseWrite
+		if b.options.WriteOnClose {
+			op |= Write
+		}
+	}
+	if mask&unix.IN_ATTRIB != 0 {
+		op |= Chmod
+	}
+	if mask&(unix.IN_DELETE|unix.IN_DELETE_SELF) != 0 {
+		op |= Remove
+	}
+	if mask&unix.IN_MOVED_FROM != 0 {
+		op |= Rename | MovedFrom
+	}
+	if mask&unix.IN_MOVED_TO != 0 {
+		op |= Create | MovedTo
+	}
+	if mask&unix.IN_MOVE_SELF != 0 {
+		op |= Rename
+	}
+	if mask&unix.IN_UNMOUNT != 0 {
+		op |= Unmount
+	}
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		op |= Overflow
+	}
+	return op
+}
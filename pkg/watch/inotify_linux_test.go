@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotify(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	barFilePath := filepath.Join(baseDir, "bar")
+
+	b, err := NewInotify(InotifyOptions{WriteOnClose: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer b.Close()
+	if err := b.Add(baseDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	// The IN_MODIFY is not reported, the create and write are reported when the file is closed
+	expectEvent(t, b, Event{Name: fooFilePath, Op: Create | Write | CloseWrite})
+
+	if err := os.Rename(fooFilePath, barFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	event := <-b.Events()
+	if event.Op != Move || event.OldName != fooFilePath || event.Name != barFilePath || event.Cookie == 0 {
+		t.Errorf("expected move from %q to %q, got %+v", fooFilePath, barFilePath, event)
+	}
+
+	if err := os.Remove(barFilePath); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	expectEvent(t, b, Event{Name: barFilePath, Op: Remove})
+
+	// The watch of the removed directory is dropped
+	if err := os.Remove(baseDir); err != nil {
+		t.Fatalf("unable to remove directory: %v", err)
+	}
+	expectEvent(t, b, Event{Name: baseDir, Op: Remove})
+	expectEvent(t, b, Event{Name: baseDir, Op: Ignored})
+}
+
+func TestInotifyDeferredCreate(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	barFilePath := filepath.Join(baseDir, "bar")
+	linkPath := filepath.Join(baseDir, "link")
+
+	b, err := NewInotify(InotifyOptions{WriteOnClose: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer b.Close()
+	if err := b.Add(baseDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The file being written is not reported until it is closed
+	f, err := os.Create(fooFilePath)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	if _, err := f.Write([]byte("foo")); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	select {
+	case event := <-b.Events():
+		t.Errorf("unexpected event %s %q before the file was closed", event.Op, event.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unable to close file: %v", err)
+	}
+	expectEvent(t, b, Event{Name: fooFilePath, Op: Create | Write | CloseWrite})
+
+	// The file created without write is reported on close as well
+	f, err = os.OpenFile(barFilePath, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unable to close file: %v", err)
+	}
+	expectEvent(t, b, Event{Name: barFilePath, Op: Create})
+
+	// The symlinks are not opened, they are reported immediately
+	if err := os.Symlink(fooFilePath, linkPath); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	expectEvent(t, b, Event{Name: linkPath, Op: Create})
+}
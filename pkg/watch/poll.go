@@ -0,0 +1,242 @@
+package watch
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/sysstat"
+)
+
+// DefaultPollInterval is the interval the polling backend stats the watched paths.
+const DefaultPollInterval = time.Second
+
+// poller watches the paths by periodically comparing their stat. It works on any filesystem, including
+// NFS, FUSE and procfs, at the cost of the polling latency.
+type poller struct {
+	interval time.Duration
+	clock    clock.Clock
+	// fsys is the filesystem the paths are polled in, nil for the OS filesystem
+	fsys fs.FS
+
+	mutex sync.Mutex
+	// watches maps the watched path to the last observed stat of the file or the directory entries
+	watches map[string]map[string]os.FileInfo
+	// failing are the watched paths that failed the last poll, their errors are reported only once
+	failing map[string]bool
+
+	events    chan Event
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPoller returns the backend that stats the watched paths every interval. Directories are watched by
+// listing their entries.
+func NewPoller(interval time.Duration) Backend {
+	return NewPollerFS(interval, nil, nil)
+}
+
+// NewPollerFS returns the polling backend for the paths in the filesystem. The names are passed to the
+// filesystem as they are, so it must implement fs.StatFS and fs.ReadDirFS for the names that are not valid
+// io/fs paths (eg. absolute paths). The clock drives the polling, it defaults to the real clock.
+func NewPollerFS(interval time.Duration, fsys fs.FS, c clock.Clock) Backend {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	p := &poller{
+		fsys:     fsys,
+		interval: interval,
+		clock:    clock.Default(c),
+		watches:  map[string]map[string]os.FileInfo{},
+		failing:  map[string]bool{},
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *poller) Add(name string) error {
+	name = filepath.Clean(name)
+	state, err := p.pollState(name)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, exists := p.watches[name]; !exists {
+		p.watches[name] = state
+	}
+	return nil
+}
+
+func (p *poller) Remove(name string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.watches, filepath.Clean(name))
+	delete(p.failing, filepath.Clean(name))
+	return nil
+}
+
+func (p *poller) Events() <-chan Event {
+	return p.events
+}
+
+func (p *poller) Errors() <-chan error {
+	return p.errors
+}
+
+func (p *poller) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *poller) run() {
+	ticker := p.clock.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			events, errs := p.poll()
+			for _, err := range errs {
+				select {
+				case p.errors <- err:
+				case <-p.done:
+					return
+				}
+			}
+			for _, event := range events {
+				select {
+				case p.events <- event:
+				case <-p.done:
+					return
+				}
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// poll returns the changes and the errors since the last poll. The error of the path is returned only when
+// the path starts failing, not on every poll. The events and errors are sent without holding the lock, so the
+// consumer can add and remove watches.
+func (p *poller) poll() ([]Event, []error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var events []Event
+	var errs []error
+	for name, old := range p.watches {
+		state, err := p.pollState(name)
+		if os.IsNotExist(err) {
+			state = map[string]os.FileInfo{}
+		} else if err != nil {
+			// Keep the last state and retry on the next poll
+			if !p.failing[name] {
+				errs = append(errs, err)
+				p.failing[name] = true
+			}
+			continue
+		}
+		delete(p.failing, name)
+		events = append(events, diffStates(old, state)...)
+		p.watches[name] = state
+	}
+	return events, errs
+}
+
+// pollState returns the stat of the file following the symlinks, or the stat of the entries when the
+// name is a directory.
+func (p *poller) pollState(name string) (map[string]os.FileInfo, error) {
+	stat, err := p.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return map[string]os.FileInfo{name: stat}, nil
+	}
+	entries, err := p.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]os.FileInfo, len(entries))
+	for _, entry := range entries {
+		state[filepath.Join(name, entry.Name())] = entry
+	}
+	return state, nil
+}
+
+func (p *poller) stat(name string) (os.FileInfo, error) {
+	if p.fsys == nil {
+		return os.Stat(name)
+	}
+	return fs.Stat(p.fsys, name)
+}
+
+// readDir returns the information of the directory entries, not following the symlinks.
+func (p *poller) readDir(name string) ([]os.FileInfo, error) {
+	if p.fsys == nil {
+		return ioutil.ReadDir(name)
+	}
+	entries, err := fs.ReadDir(p.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// diffStates returns the events that turn the old state to the new state, sorted by name. A write takes
+// precedence over the mode change.
+func diffStates(old, new map[string]os.FileInfo) []Event {
+	var events []Event
+	for name, n := range new {
+		o, exists := old[name]
+		switch {
+		case !exists:
+			events = append(events, Event{Name: name, Op: Create})
+		case o.Size() != n.Size() || !o.ModTime().Equal(n.ModTime()) || sysChanged(o, n):
+			events = append(events, Event{Name: name, Op: Write})
+		case o.Mode() != n.Mode():
+			events = append(events, Event{Name: name, Op: Chmod})
+		}
+	}
+	for name := range old {
+		if _, exists := new[name]; !exists {
+			events = append(events, Event{Name: name, Op: Remove})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// sysChanged returns true when the file was replaced (eg. by rename) or its change time moved, which catches
+// the rewrites of the same size within the modification time granularity. The change time also moves on
+// chmod, which is reported as the mode change.
+func sysChanged(old, new os.FileInfo) bool {
+	oldStat, ok := sysstat.FromFileInfo(old)
+	if !ok {
+		return false
+	}
+	newStat, ok := sysstat.FromFileInfo(new)
+	if !ok {
+		return false
+	}
+	return oldStat.Inode != newStat.Inode || (!oldStat.ChangeTime.Equal(newStat.ChangeTime) && old.Mode() == new.Mode())
+}
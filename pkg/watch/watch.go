@@ -0,0 +1,91 @@
+package watch
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrEventOverflow is reported when the events were lost because the kernel event queue overflowed.
+var ErrEventOverflow = errors.New("event queue overflow")
+
+// Op describes the filesystem operation observed by the backend.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+
+	// The following operations are reported only by the inotify backend.
+
+	// CloseWrite is reported when the file opened for writing was closed.
+	CloseWrite
+	// MovedFrom and MovedTo are the halves of the rename that were not paired (eg. the file was moved
+	// out of or into the watched directory). They are reported together with Rename and Create.
+	MovedFrom
+	MovedTo
+	// Move is the rename within the watched directories, the event has the OldName set.
+	Move
+	// Overflow is reported when the kernel event queue overflowed and the events were lost.
+	Overflow
+	// Unmount is reported when the filesystem of the watched path was unmounted.
+	Unmount
+	// Ignored is reported when the watch was removed because the watched path was deleted or unmounted.
+	Ignored
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Write, "WRITE"},
+	{Remove, "REMOVE"},
+	{Rename, "RENAME"},
+	{Chmod, "CHMOD"},
+	{CloseWrite, "CLOSE_WRITE"},
+	{MovedFrom, "MOVED_FROM"},
+	{MovedTo, "MOVED_TO"},
+	{Move, "MOVE"},
+	{Overflow, "OVERFLOW"},
+	{Unmount, "UNMOUNT"},
+	{Ignored, "IGNORED"},
+}
+
+func (op Op) String() string {
+	var names []string
+	for _, n := range opNames {
+		if op&n.op == n.op {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is the filesystem change of the watched file or of the file in the watched directory.
+type Event struct {
+	Name string
+	Op   Op
+
+	// OldName is the name of the file before the Move.
+	OldName string
+	// Cookie pairs the halves of the rename, it is set only by the inotify backend.
+	Cookie uint32
+}
+
+// Backend watches the files and directories for changes.
+type Backend interface {
+	// Add starts watching the file or directory. Adding the watched path is no-op.
+	Add(name string) error
+	// Remove stops watching the file or directory.
+	Remove(name string) error
+	// Events returns the channel with the observed changes.
+	Events() <-chan Event
+	// Errors returns the channel with the errors that occurred while watching.
+	Errors() <-chan error
+	// Close stops watching all paths.
+	Close() error
+}
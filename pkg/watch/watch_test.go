@@ -0,0 +1,234 @@
+package watch
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mfojtik/fsinformer/pkg/clock"
+	"github.com/mfojtik/fsinformer/pkg/sysstat"
+)
+
+func expectEvent(t *testing.T, b Backend, want Event) {
+	t.Helper()
+	select {
+	case got := <-b.Events():
+		if got != want {
+			t.Errorf("expected %s %q, got %s %q", want.Op, want.Name, got.Op, got.Name)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("timeout while waiting for %s %q", want.Op, want.Name)
+	}
+}
+
+func TestPoller(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	barFilePath := filepath.Join(baseDir, "bar")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	p := NewPoller(10 * time.Millisecond)
+	defer p.Close()
+	if err := p.Add(filepath.Join(baseDir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected not exists error, got %v", err)
+	}
+	if err := p.Add(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	expectEvent(t, p, Event{Name: fooFilePath, Op: Write})
+	if err := os.Chmod(fooFilePath, 0600); err != nil {
+		t.Fatalf("unable to chmod file: %v", err)
+	}
+	expectEvent(t, p, Event{Name: fooFilePath, Op: Chmod})
+	if err := os.Remove(fooFilePath); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	expectEvent(t, p, Event{Name: fooFilePath, Op: Remove})
+	if err := p.Remove(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Directories report the changes of their entries
+	if err := p.Add(baseDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(barFilePath, []byte("bar"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	expectEvent(t, p, Event{Name: barFilePath, Op: Create})
+}
+
+func TestPollerClock(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fakeClock := clock.NewFake(time.Now())
+	p := NewPollerFS(time.Hour, nil, fakeClock)
+	defer p.Close()
+	if err := p.Add(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for deadline := time.Now().Add(4 * time.Second); fakeClock.Waiters() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout while waiting for the poll ticker")
+		}
+	}
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	// The change is observed only when the clock moves
+	select {
+	case event := <-p.Events():
+		t.Fatalf("unexpected event %s %q", event.Op, event.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fakeClock.Advance(time.Hour)
+	expectEvent(t, p, Event{Name: fooFilePath, Op: Write})
+}
+
+func TestPollerReplace(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	tmpFilePath := filepath.Join(baseDir, "foo.tmp")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	info, err := os.Stat(fooFilePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := sysstat.FromFileInfo(info); !ok {
+		t.Skip("inode is not available on this platform")
+	}
+
+	p := NewPoller(10 * time.Millisecond)
+	defer p.Close()
+	if err := p.Add(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The file of the same size and modification time replaced by rename is observed by the inode
+	if err := ioutil.WriteFile(tmpFilePath, []byte("bar"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if err := os.Chtimes(tmpFilePath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("unable to change times: %v", err)
+	}
+	if err := os.Rename(tmpFilePath, fooFilePath); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	expectEvent(t, p, Event{Name: fooFilePath, Op: Write})
+}
+
+// flakyFS is the OS filesystem that fails to stat the files while failing is set.
+type flakyFS struct {
+	failing int32
+}
+
+func (f *flakyFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (f *flakyFS) Stat(name string) (fs.FileInfo, error) {
+	if atomic.LoadInt32(&f.failing) == 1 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrPermission}
+	}
+	return os.Stat(name)
+}
+
+func TestPollerErrors(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	fsys := &flakyFS{}
+	p := NewPollerFS(time.Hour, fsys, clock.NewFake(time.Now())).(*poller)
+	defer p.Close()
+	if err := p.Add(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The error is reported when the path starts failing, not on every poll
+	atomic.StoreInt32(&fsys.failing, 1)
+	for i, want := range []int{1, 0, 0} {
+		if _, errs := p.poll(); len(errs) != want {
+			t.Errorf("poll %d: expected %d errors, got %v", i, want, errs)
+		}
+	}
+	atomic.StoreInt32(&fsys.failing, 0)
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if events, errs := p.poll(); len(errs) != 0 || len(events) != 1 || events[0].Op != Write {
+		t.Errorf("expected write after recovery, got %v (%v)", events, errs)
+	}
+	atomic.StoreInt32(&fsys.failing, 1)
+	if _, errs := p.poll(); len(errs) != 1 {
+		t.Errorf("expected the error reported again after recovery, got %v", errs)
+	}
+}
+
+type failingBackend struct {
+	Backend
+}
+
+func (b *failingBackend) Add(name string) error {
+	return errors.New("no space left on device")
+}
+
+func TestWithFallback(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	fooFilePath := filepath.Join(baseDir, "foo")
+	if err := ioutil.WriteFile(fooFilePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	b := WithFallback(&failingBackend{Backend: NewPoller(time.Hour)}, NewPoller(10*time.Millisecond))
+	defer b.Close()
+	if err := b.Add(fooFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Add(filepath.Join(baseDir, "missing")); err == nil {
+		t.Errorf("expected error when no backend can watch the path")
+	}
+	if err := ioutil.WriteFile(fooFilePath, []byte("updated"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	expectEvent(t, b, Event{Name: fooFilePath, Op: Write})
+}